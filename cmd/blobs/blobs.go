@@ -0,0 +1,117 @@
+// Command blobs maintains the image blob storage.
+//
+//	go run ./cmd/blobs import   moves images stored as gallery-<id>/<filename> into blob storage
+//	go run ./cmd/blobs gc       deletes blobs no image refers to anymore
+//	go run ./cmd/blobs reconcile [-repair]
+//	                            reports files and blobs that don't match, and
+//	                            fixes what it safely can with -repair
+//	go run ./cmd/blobs scrub [-rate bytes]
+//	                            verifies every file that is due against its
+//	                            checksum
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"archazid.io/lenslocked/models"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: blobs import|gc|reconcile [-repair]|scrub [-rate bytes]")
+		os.Exit(1)
+	}
+
+	service, err := galleryService()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "import":
+		n, err := service.ImportLegacyImages()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d images.\n", n)
+	case "gc":
+		n, err := service.CollectGarbage(models.DefaultBlobGracePeriod)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Deleted %d blobs.\n", n)
+	case "reconcile":
+		flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "fix the problems found instead of only reporting them")
+		flags.Parse(os.Args[2:])
+		report, err := service.Reconcile(*repair)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, problem := range report.Problems {
+			fmt.Println(problem)
+		}
+		fmt.Printf("Checked %d files and %d blobs, found %d problems.\n",
+			report.Files, report.Blobs, len(report.Problems))
+		if !*repair && len(report.Problems) > 0 {
+			fmt.Println("Nothing was changed, run again with -repair to fix them.")
+		}
+	case "scrub":
+		flags := flag.NewFlagSet("scrub", flag.ExitOnError)
+		rate := flags.Int64("rate", 0, "bytes read per second, or 0 for no limit")
+		flags.Parse(os.Args[2:])
+		checked, failed := 0, 0
+		for {
+			report, err := service.Scrub(models.DefaultScrubInterval, 100, *rate)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, failure := range report.Failures {
+				fmt.Printf("%s: %s\n", failure.Key, failure.Detail)
+			}
+			checked += report.Checked
+			failed += len(report.Failures)
+			if report.Checked == 0 {
+				break
+			}
+		}
+		fmt.Printf("Verified %d files, %d failed.\n", checked, failed)
+	default:
+		fmt.Printf("Invalid command: %v\n", os.Args[1])
+		os.Exit(1)
+	}
+}
+
+func galleryService() (*models.GalleryService, error) {
+	godotenv.Load()
+	db, err := models.Open(models.DefaultPostgresConfig())
+	if err != nil {
+		return nil, err
+	}
+	storage, err := models.NewStorage(models.StorageConfig{
+		Backend: os.Getenv("STORAGE_BACKEND"),
+		Dir:     os.Getenv("STORAGE_DIR"),
+		S3: models.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          os.Getenv("S3_BUCKET"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &models.GalleryService{
+		DB:      db,
+		Storage: storage,
+	}, nil
+}
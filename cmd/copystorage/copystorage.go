@@ -0,0 +1,115 @@
+// Command copystorage copies every image file from one storage backend to
+// another, for example when moving from local disk to S3:
+//
+//	go run ./cmd/copystorage -from local:images -to s3:lenslocked-images
+//
+// Backends are given as "local:<dir>" or "s3:<bucket>". The S3 endpoint,
+// region and credentials are read from the same S3_* environment variables
+// as the server.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"archazid.io/lenslocked/models"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	from := flag.String("from", "", "storage to copy from")
+	to := flag.String("to", "", "storage to copy to")
+	prefix := flag.String("prefix", "", "only copy keys starting with this prefix")
+	overwrite := flag.Bool("overwrite", false, "copy files that already exist at the destination with the same size")
+	flag.Parse()
+
+	// The .env file is optional here, the S3 settings may come from the
+	// environment instead.
+	godotenv.Load()
+
+	src, err := storage(*from)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	dst, err := storage(*to)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = copyAll(src, dst, *prefix, *overwrite)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func storage(spec string) (models.Storage, error) {
+	backend, location, ok := strings.Cut(spec, ":")
+	if !ok || location == "" {
+		return nil, fmt.Errorf("invalid storage %q: expected local:<dir> or s3:<bucket>", spec)
+	}
+	config := models.StorageConfig{
+		Backend: backend,
+	}
+	switch backend {
+	case "local":
+		config.Dir = location
+	case "s3":
+		config.S3 = models.S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          os.Getenv("S3_REGION"),
+			Bucket:          location,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		}
+	}
+	return models.NewStorage(config)
+}
+
+func copyAll(src, dst models.Storage, prefix string, overwrite bool) error {
+	objects, err := src.List(prefix)
+	if err != nil {
+		return fmt.Errorf("listing source: %w", err)
+	}
+
+	var copied, skipped int
+	for _, obj := range objects {
+		if !overwrite {
+			existing, err := dst.Stat(obj.Key)
+			if err == nil && existing.Size == obj.Size {
+				skipped++
+				continue
+			}
+			if err != nil && !errors.Is(err, models.ErrNotFound) {
+				return fmt.Errorf("checking %v: %w", obj.Key, err)
+			}
+		}
+
+		err := copyObject(src, dst, obj.Key)
+		if err != nil {
+			return err
+		}
+		copied++
+		fmt.Printf("copied %v (%d bytes)\n", obj.Key, obj.Size)
+	}
+	fmt.Printf("Done: %d copied, %d already present.\n", copied, skipped)
+	return nil
+}
+
+func copyObject(src, dst models.Storage, key string) error {
+	r, err := src.Get(key)
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", key, err)
+	}
+	defer r.Close()
+	err = dst.Put(key, r)
+	if err != nil {
+		return fmt.Errorf("writing %v: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+
+	"archazid.io/lenslocked/models"
+)
+
+// immutableMaxAge keeps responses for a year, the longest browsers honor.
+const immutableMaxAge = "max-age=31536000, immutable"
+
+// cacheImage sets the caching headers of a response serving image, before
+// http.ServeContent answers conditional requests with them.
+//
+// Pages link images with imageVersion in the "v" query value. Those URLs
+// always serve the same bytes, since replacing the image or changing the
+// gallery settings changes the version, so browsers can keep them without
+// asking again. Any other URL is revalidated on every use, which costs a 304
+// instead of the whole image while the ETag still matches. Watermarked
+// images change with the settings of the owner rather than the gallery, so
+// they are always revalidated.
+func cacheImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, image models.Image, etag string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	// Only public galleries may be kept by shared caches. The others depend
+	// on who is asking.
+	scope := "private"
+	if gallery.Visibility == models.VisibilityPublic && !gallery.Watermark {
+		scope = "public"
+	}
+	version := r.URL.Query().Get("v")
+	if version != "" && version == imageVersion(gallery, image) && !gallery.Watermark {
+		w.Header().Set("Cache-Control", scope+", "+immutableMaxAge)
+		return
+	}
+	w.Header().Set("Cache-Control", scope+", no-cache")
+}
+
+// imageVersion is the "v" query value pages link an image with. Besides the
+// contents of the image, it covers the gallery settings that change what is
+// served and who may keep it, so making a gallery private or watermarking it
+// moves its images to new URLs instead of leaving caches with the old bytes.
+func imageVersion(gallery *models.Gallery, image models.Image) string {
+	version := image.Version()
+	if version == "" {
+		return ""
+	}
+	settings := sha256.Sum256([]byte(gallery.Visibility + "/" + strconv.FormatBool(gallery.Watermark)))
+	return version + "-" + hex.EncodeToString(settings[:4])
+}
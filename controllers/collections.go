@@ -0,0 +1,451 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+type Collections struct {
+	Templates struct {
+		New   Template
+		Edit  Template
+		Index Template
+		Show  Template
+	}
+	CollectionService *models.CollectionService
+	GalleryService    *models.GalleryService
+}
+
+// collectionOption is a collection a gallery or collection can be moved into,
+// indented to show where it is in the tree.
+type collectionOption struct {
+	ID    int
+	Title string
+	Depth int
+	// Label is the title indented by depth.
+	Label string
+}
+
+// breadcrumb links to one of the collections containing a page.
+type breadcrumb struct {
+	ID    int
+	Title string
+}
+
+// card is a gallery or collection shown with its cover image.
+type card struct {
+	Path  string
+	Title string
+	// CoverURL is empty when there is no image to show.
+	CoverURL string
+	Private  bool
+}
+
+func (c Collections) Index(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Collections []collectionOption
+	}
+	user := context.User(r.Context())
+	collections, err := c.CollectionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Collections = collectionTree(collections, 0)
+
+	c.Templates.Index.Execute(w, r, data)
+}
+
+func (c Collections) New(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Title    string
+		ParentID int
+		Parents  []collectionOption
+	}
+	data.Title = r.FormValue("title")
+	data.ParentID, _ = strconv.Atoi(r.FormValue("parent"))
+	user := context.User(r.Context())
+	collections, err := c.CollectionService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Parents = collectionTree(collections, 0)
+
+	c.Templates.New.Execute(w, r, data)
+}
+
+func (c Collections) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	parentID, err := c.parentID(r, user.ID)
+	if err != nil {
+		http.Error(w, "Invalid parent collection", http.StatusBadRequest)
+		return
+	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		http.Error(w, "A title is required", http.StatusBadRequest)
+		return
+	}
+
+	collection, err := c.CollectionService.Create(user.ID, title, parentID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/collections/%d/edit", collection.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Show lists the sub-collections and galleries of a collection. Visitors other
+// than the owner only see what is public.
+func (c Collections) Show(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userCanViewCollection)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	owner := user != nil && user.ID == collection.UserID
+
+	var data struct {
+		ID          int
+		Title       string
+		Owner       bool
+		Breadcrumbs []breadcrumb
+		Collections []card
+		Galleries   []card
+	}
+	data.ID = collection.ID
+	data.Title = collection.Title
+	data.Owner = owner
+	data.Breadcrumbs, err = collectionBreadcrumbs(c.CollectionService, collection.ParentID, owner)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	children, err := c.CollectionService.Children(collection.ID, !owner)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, child := range children {
+		cover, err := c.CollectionService.Cover(child, !owner)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Collections = append(data.Collections, card{
+			Path:     fmt.Sprintf("/collections/%d", child.ID),
+			Title:    child.Title,
+			CoverURL: imageURL(cover),
+			Private:  child.Visibility == models.VisibilityPrivate,
+		})
+	}
+
+	galleries, err := c.GalleryService.ByCollectionID(collection.ID, !owner)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range galleries {
+		cover, err := c.GalleryService.Cover(gallery.ID)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Galleries = append(data.Galleries, card{
+			Path:     fmt.Sprintf("/galleries/%d", gallery.ID),
+			Title:    gallery.Title,
+			CoverURL: imageURL(cover),
+			Private:  gallery.Visibility == models.VisibilityPrivate,
+		})
+	}
+
+	c.Templates.Show.Execute(w, r, data)
+}
+
+func (c Collections) Edit(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+	c.renderEdit(w, r, collection)
+}
+
+func (c Collections) renderEdit(w http.ResponseWriter, r *http.Request, collection *models.Collection, errs ...error) {
+	type Cover struct {
+		ID       string
+		Filename string
+	}
+	var data struct {
+		ID           int
+		Title        string
+		Private      bool
+		ParentID     int
+		Parents      []collectionOption
+		CoverImageID string
+		Covers       []Cover
+	}
+	data.ID = collection.ID
+	data.Title = collection.Title
+	data.Private = collection.Visibility == models.VisibilityPrivate
+	data.ParentID = collection.ParentID
+	data.CoverImageID = collection.CoverImageID
+
+	collections, err := c.CollectionService.ByUserID(collection.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// A collection can't move into itself or its own sub-collections, so
+	// they aren't offered.
+	data.Parents = withoutSubtree(collectionTree(collections, 0), collection.ID)
+
+	images, err := c.CollectionService.CoverCandidates(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, image := range images {
+		data.Covers = append(data.Covers, Cover{
+			ID:       image.ID,
+			Filename: image.Filename,
+		})
+	}
+
+	c.Templates.Edit.Execute(w, r, data, errs...)
+}
+
+func (c Collections) Update(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+
+	parentID, err := c.parentID(r, collection.UserID)
+	if err != nil {
+		http.Error(w, "Invalid parent collection", http.StatusBadRequest)
+		return
+	}
+	if title := strings.TrimSpace(r.FormValue("title")); title != "" {
+		collection.Title = title
+	}
+	collection.ParentID = parentID
+	collection.Visibility = models.VisibilityPublic
+	if r.FormValue("visibility") == models.VisibilityPrivate {
+		collection.Visibility = models.VisibilityPrivate
+	}
+	collection.CoverImageID = r.FormValue("cover")
+	if collection.CoverImageID != "" {
+		if !c.isCoverCandidate(collection.ID, collection.CoverImageID) {
+			http.Error(w, "Invalid cover image", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = c.CollectionService.Update(collection)
+	if err != nil {
+		if errors.Is(err, models.ErrCollectionCycle) {
+			err = errors.Public(err, "A collection can't be moved into one of its own sub-collections.")
+			c.renderEdit(w, r, collection, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/collections/%d/edit", collection.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (c Collections) Delete(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionByID(w, r, userMustOwnCollection)
+	if err != nil {
+		return
+	}
+	err = c.CollectionService.Delete(collection.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/collections/me", http.StatusFound)
+}
+
+// parentID reads the "parent_id" form value, checking the collection belongs
+// to the user. Zero means no parent.
+func (c Collections) parentID(r *http.Request, userID int) (int, error) {
+	value := r.FormValue("parent_id")
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	parent, err := c.CollectionService.ByID(id)
+	if err != nil {
+		return 0, err
+	}
+	if parent.UserID != userID {
+		return 0, fmt.Errorf("collection %d belongs to another user", id)
+	}
+	return id, nil
+}
+
+func (c Collections) isCoverCandidate(collectionID int, imageID string) bool {
+	images, err := c.CollectionService.CoverCandidates(collectionID)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	for _, image := range images {
+		if image.ID == imageID {
+			return true
+		}
+	}
+	return false
+}
+
+type collectionOpt func(http.ResponseWriter, *http.Request, *models.Collection) error
+
+func (c Collections) collectionByID(w http.ResponseWriter, r *http.Request, opts ...collectionOpt) (*models.Collection, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+	collection, err := c.CollectionService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		err = opt(w, r, collection)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return collection, nil
+}
+
+func userMustOwnCollection(w http.ResponseWriter, r *http.Request, collection *models.Collection) error {
+	user := context.User(r.Context())
+	if user == nil || collection.UserID != user.ID {
+		http.Error(w, "You are not authorized to edit this collection", http.StatusForbidden)
+		return fmt.Errorf("user does not have access to this collection")
+	}
+	return nil
+}
+
+func userCanViewCollection(w http.ResponseWriter, r *http.Request, collection *models.Collection) error {
+	user := context.User(r.Context())
+	if collection.Visibility != models.VisibilityPublic && (user == nil || collection.UserID != user.ID) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return fmt.Errorf("user does not have access to this collection")
+	}
+	return nil
+}
+
+// collectionBreadcrumbs returns links to the collection with the given ID and
+// those containing it, outermost first. Unless the visitor is the owner, the
+// trail stops below the innermost private collection.
+func collectionBreadcrumbs(service *models.CollectionService, id int, owner bool) ([]breadcrumb, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	collections, err := service.Breadcrumbs(id)
+	if err != nil {
+		return nil, err
+	}
+	var crumbs []breadcrumb
+	for _, collection := range collections {
+		if !owner && collection.Visibility != models.VisibilityPublic {
+			crumbs = nil
+			continue
+		}
+		crumbs = append(crumbs, breadcrumb{
+			ID:    collection.ID,
+			Title: collection.Title,
+		})
+	}
+	return crumbs, nil
+}
+
+// collectionTree orders collections depth first starting from those in the
+// parent with the given ID, keeping their order otherwise.
+func collectionTree(collections []models.Collection, parentID int) []collectionOption {
+	return appendCollectionTree(nil, collections, parentID, 0)
+}
+
+func appendCollectionTree(options []collectionOption, collections []models.Collection, parentID, depth int) []collectionOption {
+	for _, collection := range collections {
+		if collection.ParentID != parentID {
+			continue
+		}
+		options = append(options, collectionOption{
+			ID:    collection.ID,
+			Title: collection.Title,
+			Depth: depth,
+			Label: strings.Repeat("\u00a0\u00a0", depth) + collection.Title,
+		})
+		options = appendCollectionTree(options, collections, collection.ID, depth+1)
+	}
+	return options
+}
+
+// withoutSubtree removes a collection and everything below it from a list
+// ordered by collectionTree.
+func withoutSubtree(options []collectionOption, id int) []collectionOption {
+	var kept []collectionOption
+	skipDepth := -1
+	for _, option := range options {
+		if skipDepth >= 0 {
+			if option.Depth > skipDepth {
+				continue
+			}
+			skipDepth = -1
+		}
+		if option.ID == id {
+			skipDepth = option.Depth
+			continue
+		}
+		kept = append(kept, option)
+	}
+	return kept
+}
+
+// imageURL returns the URL of an image, or "" for the zero Image.
+func imageURL(image models.Image) string {
+	if image.ID == "" {
+		return ""
+	}
+	return fmt.Sprintf("/galleries/%d/images/%s", image.GalleryID, image.ID)
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Comments shows an image along with the comments on it. Owners also see
+// hidden comments and those waiting for approval.
+func (g Galleries) Comments(w http.ResponseWriter, r *http.Request) {
+	g.renderComments(w, r, models.Comment{})
+}
+
+// renderComments shows the comments page. draft holds what the visitor typed
+// when their comment couldn't be saved.
+func (g Galleries) renderComments(w http.ResponseWriter, r *http.Request, draft models.Comment, errs ...error) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	image, err := g.GalleryService.Image(gallery.ID, chi.URLParam(r, "imageID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	access := g.access(r, gallery)
+	comments, err := g.CommentService.ForImage(gallery.ID, image.ID, access.Owner)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		GalleryID    int
+		GalleryTitle string
+		ImageID      string
+		ImageVersion string
+		Filename     string
+		Caption      string
+		Owner        bool
+		CanComment   bool
+		// Name and Body are what the visitor typed. Everyone signs their
+		// comments with a name, so email addresses are never shown.
+		Name     string
+		Body     string
+		Pending  bool
+		Comments []commentThread
+	}
+	data.GalleryID = gallery.ID
+	data.GalleryTitle = gallery.Title
+	data.ImageID = image.ID
+	data.ImageVersion = imageVersion(gallery, image)
+	data.Filename = image.Filename
+	data.Caption = image.Caption
+	data.Owner = access.Owner
+	signedIn := context.User(r.Context()) != nil
+	data.CanComment = signedIn || access.ShareLink != nil
+	data.Name = draft.AuthorName
+	data.Body = draft.Body
+	data.Pending = r.FormValue("pending") == "true"
+	data.Comments = commentThreads(comments, data.Owner, data.CanComment)
+
+	g.Templates.Comments.Execute(w, r, data, errs...)
+}
+
+// commentThread is a comment and its replies as shown on the comments page.
+// The template renders threads recursively, so each one carries what the
+// visitor may do with it.
+type commentThread struct {
+	ID         int
+	GalleryID  int
+	ImageID    string
+	AuthorName string
+	Body       string
+	Status     string
+	CreatedAt  string
+	Replies    []commentThread
+
+	Owner    bool
+	CanReply bool
+}
+
+func commentThreads(comments []*models.Comment, owner, canReply bool) []commentThread {
+	var threads []commentThread
+	for _, comment := range comments {
+		threads = append(threads, commentThread{
+			ID:         comment.ID,
+			GalleryID:  comment.GalleryID,
+			ImageID:    comment.ImageID,
+			AuthorName: comment.AuthorName,
+			Body:       comment.Body,
+			Status:     comment.Status,
+			CreatedAt:  comment.CreatedAt.Format("Jan 2, 2006 15:04"),
+			Replies:    commentThreads(comment.Replies, owner, canReply),
+			Owner:      owner,
+			CanReply:   canReply,
+		})
+	}
+	return threads
+}
+
+// CreateComment adds a comment, or a reply to one, on an image. Signed in
+// users comment under their account, and guests who opened a share link
+// under the share link. Both sign with the name they give. Comments wait for
+// approval if the gallery asks for it, and the owner is emailed about each
+// new comment.
+func (g Galleries) CreateComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	access := g.access(r, gallery)
+	user := context.User(r.Context())
+	if user == nil && access.ShareLink == nil {
+		http.Error(w, "Sign in to comment", http.StatusForbidden)
+		return
+	}
+
+	comment := models.Comment{
+		GalleryID:  gallery.ID,
+		ImageID:    chi.URLParam(r, "imageID"),
+		Body:       r.FormValue("body"),
+		AuthorName: r.FormValue("author_name"),
+		Status:     models.CommentVisible,
+	}
+	if parentID := r.FormValue("parent_id"); parentID != "" {
+		comment.ParentID, err = strconv.Atoi(parentID)
+		if err != nil {
+			http.Error(w, "Invalid reply", http.StatusBadRequest)
+			return
+		}
+	}
+	if user != nil {
+		comment.UserID = user.ID
+	} else {
+		comment.ShareLinkID = access.ShareLink.ID
+	}
+	if strings.TrimSpace(comment.AuthorName) == "" {
+		err = errors.Public(fmt.Errorf("create comment: missing name"),
+			"Please enter your name.")
+		g.renderComments(w, r, comment, err)
+		return
+	}
+	if gallery.CommentsRequireApproval && !access.Owner {
+		comment.Status = models.CommentPending
+	}
+
+	err = g.CommentService.Create(&comment)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrCommentEmpty):
+			err = errors.Public(err, "Your comment is empty.")
+			g.renderComments(w, r, comment, err)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Image or comment not found", http.StatusNotFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	commentsPath := fmt.Sprintf("/galleries/%d/images/%s/comments", gallery.ID, url.PathEscape(comment.ImageID))
+	if !access.Owner {
+		g.notifyOwner(r, gallery, comment, commentsPath)
+	}
+	if comment.Status == models.CommentPending {
+		http.Redirect(w, r, commentsPath+"?pending=true", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s#comment-%d", commentsPath, comment.ID), http.StatusFound)
+}
+
+// notifyOwner emails the owner of a gallery about a new comment. Failing to
+// send the email doesn't undo the comment, so errors are only logged.
+func (g Galleries) notifyOwner(r *http.Request, gallery *models.Gallery, comment models.Comment, commentsPath string) {
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	image, err := g.GalleryService.Image(gallery.ID, comment.ImageID)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	commentURL := absoluteURL(r, fmt.Sprintf("%s#comment-%d", commentsPath, comment.ID))
+	err = g.EmailService.NewComment(owner.Email, comment.AuthorName, image.Filename, comment.Body, commentURL)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// ModerateComment approves, hides, shows again or deletes a comment on one
+// of the user's galleries, depending on the "action" form value.
+func (g Galleries) ModerateComment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	commentID, err := strconv.Atoi(chi.URLParam(r, "commentID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "approve", "show":
+		err = g.CommentService.SetStatus(gallery.ID, commentID, models.CommentVisible)
+	case "hide":
+		err = g.CommentService.SetStatus(gallery.ID, commentID, models.CommentHidden)
+	case "delete":
+		err = g.CommentService.Delete(gallery.ID, commentID)
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// Moderation happens either from the comments of an image or from the
+	// edit page of the gallery.
+	if imageID := r.FormValue("image_id"); imageID != "" {
+		commentsPath := fmt.Sprintf("/galleries/%d/images/%s/comments", gallery.ID, url.PathEscape(imageID))
+		http.Redirect(w, r, commentsPath, http.StatusFound)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
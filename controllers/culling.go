@@ -0,0 +1,202 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+)
+
+// cullingView is how the edit page filters and sorts images. It is read from
+// the "min_rating", "show", "label" and "sort" form values, which every form
+// on the edit page sends along so the view survives actions.
+type cullingView struct {
+	Filter models.ImageFilter
+	Sort   string
+}
+
+func readCullingView(r *http.Request) cullingView {
+	var view cullingView
+	view.Filter.MinRating, _ = strconv.Atoi(r.FormValue("min_rating"))
+	view.Filter.Flag = r.FormValue("show")
+	view.Filter.ColorLabel = r.FormValue("label")
+	view.Sort = r.FormValue("sort")
+	return view
+}
+
+// Query encodes the view as form values. It is empty for the default view.
+func (view cullingView) Query() string {
+	values := url.Values{}
+	if view.Filter.MinRating > 0 {
+		values.Set("min_rating", strconv.Itoa(view.Filter.MinRating))
+	}
+	if view.Filter.Flag != "" {
+		values.Set("show", view.Filter.Flag)
+	}
+	if view.Filter.ColorLabel != "" {
+		values.Set("label", view.Filter.ColorLabel)
+	}
+	if view.Sort != "" {
+		values.Set("sort", view.Sort)
+	}
+	return values.Encode()
+}
+
+func (view cullingView) editPath(galleryID int) string {
+	editPath := fmt.Sprintf("/galleries/%d/edit", galleryID)
+	if query := view.Query(); query != "" {
+		editPath += "?" + query
+	}
+	return editPath
+}
+
+// UpdateCulling sets the rating, flag or color label of an image, from the
+// "rating", "flag" and "color_label" form values. Values that aren't sent are
+// left as they are. The edit page sends these as the owner presses keyboard
+// shortcuts, and gets the image back as JSON.
+func (g Galleries) UpdateCulling(w http.ResponseWriter, r *http.Request) {
+	image, err := g.imageByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	r.ParseForm()
+	if _, ok := r.Form["rating"]; ok {
+		image.Rating, err = strconv.Atoi(r.FormValue("rating"))
+		if err != nil {
+			http.Error(w, "Invalid rating", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.Form["flag"]; ok {
+		image.Flag = r.FormValue("flag")
+	}
+	if _, ok := r.Form["color_label"]; ok {
+		image.ColorLabel = r.FormValue("color_label")
+	}
+	err = g.GalleryService.UpdateCulling(image)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCulling) {
+			http.Error(w, "Invalid rating, flag or color label", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			ID         string `json:"id"`
+			Rating     int    `json:"rating"`
+			Flag       string `json:"flag"`
+			ColorLabel string `json:"color_label"`
+		}{image.ID, image.Rating, image.Flag, image.ColorLabel})
+		return
+	}
+	http.Redirect(w, r, readCullingView(r).editPath(image.GalleryID), http.StatusFound)
+}
+
+// BulkImages moves to the trash, or moves or copies to another gallery of
+// the user, the images selected on the edit page. With the "all_shown" form
+// value, it acts on all the images shown with the current filter instead,
+// like every rejected image. An empty selection never means every image.
+func (g Galleries) BulkImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	view := readCullingView(r)
+	images, err := g.GalleryService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	allShown := r.FormValue("all_shown") == "true"
+	selected := make(map[string]bool)
+	for _, id := range r.Form["image_id"] {
+		selected[id] = true
+	}
+	var ids []string
+	for _, image := range models.FilterImages(images, view.Filter) {
+		if allShown || selected[image.ID] {
+			ids = append(ids, image.ID)
+		}
+	}
+	if len(ids) == 0 {
+		err = errors.Public(fmt.Errorf("bulk images: no images selected"),
+			"Select some images first, or tick \"All shown\" to act on every image shown.")
+		g.renderEdit(w, r, gallery, editNotice{}, err)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "delete":
+		err = g.GalleryService.TrashImages(gallery.ID, ids)
+	case "move":
+		toGallery, ok := g.moveTarget(r, gallery)
+		if !ok {
+			http.Error(w, "Invalid gallery", http.StatusBadRequest)
+			return
+		}
+		err = g.GalleryService.MoveImages(gallery.ID, ids, toGallery.ID)
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			err = errors.Public(err, fmt.Sprintf("The images were not moved because %q is full.", toGallery.Title))
+			g.renderEdit(w, r, gallery, editNotice{}, err)
+			return
+		}
+	case "copy":
+		toGallery, ok := g.moveTarget(r, gallery)
+		if !ok {
+			http.Error(w, "Invalid gallery", http.StatusBadRequest)
+			return
+		}
+		err = g.GalleryService.CopyImages(gallery.ID, ids, toGallery.ID)
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			full := fmt.Sprintf("%q", toGallery.Title)
+			if quotaErr.Scope == "account" {
+				full = "your account"
+			}
+			err = errors.Public(err, fmt.Sprintf("The images were not copied because %s is full.", full))
+			g.renderEdit(w, r, gallery, editNotice{}, err)
+			return
+		}
+	default:
+		http.Error(w, "Invalid action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	// The filtered images are gone, so show the rest of the gallery.
+	view.Filter = models.ImageFilter{}
+	http.Redirect(w, r, view.editPath(gallery.ID), http.StatusFound)
+}
+
+// moveTarget returns the gallery in the "to_gallery_id" form value if it is
+// another gallery of the same user.
+func (g Galleries) moveTarget(r *http.Request, gallery *models.Gallery) (*models.Gallery, bool) {
+	toGalleryID, err := strconv.Atoi(r.FormValue("to_gallery_id"))
+	if err != nil || toGalleryID == gallery.ID {
+		return nil, false
+	}
+	toGallery, err := g.GalleryService.ByID(toGalleryID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		return nil, false
+	}
+	return toGallery, toGallery.UserID == gallery.UserID
+}
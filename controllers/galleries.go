@@ -1,26 +1,51 @@
 package controllers
 
 import (
-	"errors"
+	"archive/zip"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
-	"net/url"
-	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
 	"archazid.io/lenslocked/models"
 	"github.com/go-chi/chi/v5"
 )
 
 type Galleries struct {
 	Templates struct {
-		New   Template
-		Edit  Template
-		Index Template
-		Show  Template
+		New        Template
+		Edit       Template
+		Index      Template
+		Show       Template
+		ShowImages Template
+		Duplicates Template
+		Search     Template
+		Comments   Template
+		Unlock     Template
+		Selection  Template
+		Trash      Template
+		Integrity  Template
+		Transfer   Template
 	}
-	GalleryService *models.GalleryService
+	GalleryService    *models.GalleryService
+	UploadService     *models.UploadService
+	ShareLinkService  *models.ShareLinkService
+	CollectionService *models.CollectionService
+	CommentService    *models.CommentService
+	UserService       *models.UserService
+	EmailService      *models.EmailService
+	ProofingService   *models.ProofingService
+	WatermarkService  *models.WatermarkService
+
+	// TrashRetention is how long deleted galleries and images can be
+	// restored. Defaults to models.DefaultTrashRetention.
+	TrashRetention time.Duration
 }
 
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
@@ -57,33 +82,203 @@ func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	g.renderEdit(w, r, gallery, editNotice{})
+}
+
+// editNotice is the outcome of an action that is shown at the top of the
+// edit page.
+type editNotice struct {
+	UploadResults []uploadResult
+	ImportResults []uploadResult
+	// ShareLinkURL is the URL of a share link that was just created.
+	ShareLinkURL string
+}
+
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, notice editNotice, errs ...error) {
 	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+		ID         string
+		GalleryID  int
+		Version    string
+		Filename   string
+		Caption    string
+		Tags       string
+		Rating     int
+		Flag       string
+		ColorLabel string
+		// Corrupted says what is wrong with the file of the image, if the
+		// scrubber found it corrupted.
+		Corrupted string
+	}
+	type GalleryOption struct {
+		ID    int
+		Title string
+	}
+	type ShareLink struct {
+		ID             int
+		Label          string
+		AllowDownloads bool
+		CreatedAt      string
+		ExpiresAt      string
+		Expired        bool
+		Password       bool
+		Submitted      bool
+	}
+	type Transfer struct {
+		ToEmail   string
+		ExpiresAt string
+	}
+	type Comment struct {
+		ID         int
+		GalleryID  int
+		ImageID    string
+		AuthorName string
+		Body       string
+		CreatedAt  string
 	}
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID             int
+		Title          string
+		Tags           string
+		Private        bool
+		AllowDownloads bool
+		CollectionID   int
+		Collections    []collectionOption
+		Images         []Image
+		// TotalImages counts the images in the gallery, including those
+		// left out of Images by View.
+		TotalImages int
+		// Corrupted counts the images whose files need to be uploaded again.
+		Corrupted      int
+		View           cullingView
+		Ratings        []int
+		ColorLabels    []string
+		OtherGalleries []GalleryOption
+		ShareLinks     []ShareLink
+		// CommentsRequireApproval holds back new comments until the owner
+		// approves them.
+		CommentsRequireApproval bool
+		// Watermark marks the images visitors see with the watermark of the
+		// owner.
+		Watermark       bool
+		PendingComments []Comment
+		// Transfer is the pending transfer of the gallery to another user.
+		Transfer *Transfer
+		Notice   editNotice
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
+	data.Tags = strings.Join(gallery.Tags, ", ")
+	data.Private = gallery.Visibility == models.VisibilityPrivate
+	data.AllowDownloads = gallery.AllowDownloads
+	data.CollectionID = gallery.CollectionID
+	data.CommentsRequireApproval = gallery.CommentsRequireApproval
+	data.Watermark = gallery.Watermark
+	data.Notice = notice
+	collections, err := g.CollectionService.ByUserID(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Collections = collectionTree(collections, 0)
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	corrupted, err := g.GalleryService.Corrupted(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Corrupted = len(corrupted)
+	data.TotalImages = len(images)
+	data.View = readCullingView(r)
+	images = models.FilterImages(images, data.View.Filter)
+	models.SortImages(images, data.View.Sort)
 	for _, image := range images {
 		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
+			ID:         image.ID,
+			GalleryID:  image.GalleryID,
+			Version:    imageVersion(gallery, image),
+			Filename:   image.Filename,
+			Caption:    image.Caption,
+			Tags:       strings.Join(image.Tags, ", "),
+			Rating:     image.Rating,
+			Flag:       image.Flag,
+			ColorLabel: image.ColorLabel,
+			Corrupted:  corrupted[image.ID],
+		})
+	}
+	for rating := 1; rating <= models.MaxRating; rating++ {
+		data.Ratings = append(data.Ratings, rating)
+	}
+	data.ColorLabels = models.ColorLabels
+	galleries, err := g.GalleryService.ByUserID(gallery.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, other := range galleries {
+		if other.ID != gallery.ID {
+			data.OtherGalleries = append(data.OtherGalleries, GalleryOption{other.ID, other.Title})
+		}
+	}
+	links, err := g.ShareLinkService.ByGalleryID(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, link := range links {
+		shareLink := ShareLink{
+			ID:             link.ID,
+			Label:          link.Label,
+			AllowDownloads: link.AllowDownloads,
+			CreatedAt:      link.CreatedAt.Format("Jan 2, 2006"),
+			Expired:        link.Expired(),
+			Password:       link.PasswordHash != "",
+			Submitted:      link.Submitted(),
+		}
+		if !link.ExpiresAt.IsZero() {
+			shareLink.ExpiresAt = link.ExpiresAt.Format("Jan 2, 2006")
+		}
+		data.ShareLinks = append(data.ShareLinks, shareLink)
+	}
+	comments, err := g.CommentService.Pending(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, comment := range comments {
+		data.PendingComments = append(data.PendingComments, Comment{
+			ID:         comment.ID,
+			GalleryID:  comment.GalleryID,
+			ImageID:    comment.ImageID,
+			AuthorName: comment.AuthorName,
+			Body:       comment.Body,
+			CreatedAt:  comment.CreatedAt.Format("Jan 2, 2006"),
 		})
 	}
 
-	g.Templates.Edit.Execute(w, r, data)
+	transfer, err := g.GalleryService.PendingTransfer(gallery.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		data.Transfer = &Transfer{
+			ToEmail:   transfer.ToEmail,
+			ExpiresAt: transfer.ExpiresAt.Format("Jan 2, 2006"),
+		}
+	}
+
+	g.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
@@ -94,6 +289,19 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 
 	title := r.FormValue("title")
 	gallery.Title = title
+	gallery.Tags = models.ParseTags(r.FormValue("tags"))
+	gallery.Visibility = models.VisibilityPublic
+	if r.FormValue("visibility") == models.VisibilityPrivate {
+		gallery.Visibility = models.VisibilityPrivate
+	}
+	gallery.AllowDownloads = r.FormValue("allow_downloads") == "true"
+	gallery.CommentsRequireApproval = r.FormValue("comments_require_approval") == "true"
+	gallery.Watermark = r.FormValue("watermark") == "true"
+	gallery.CollectionID, err = g.collectionID(r, gallery.UserID)
+	if err != nil {
+		http.Error(w, "Invalid collection", http.StatusBadRequest)
+		return
+	}
 	err = g.GalleryService.Update(gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -105,28 +313,137 @@ func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// gallerySortLabels name the orders galleries can be listed in.
+var gallerySortLabels = map[string]string{
+	models.GallerySortNewest:  "Newest",
+	models.GallerySortUpdated: "Recently updated",
+	models.GallerySortTitle:   "Title",
+	models.GallerySortImages:  "Most images",
+}
+
+// Index lists the galleries of the current user a page at a time, sorted and
+// filtered with the "sort", "tag" and "visibility" query values. The "after"
+// value is the cursor of the page.
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID        int
+		Title     string
+		Private   bool
+		Images    int
+		Size      string
+		UpdatedAt string
+	}
+	type SortOption struct {
+		Value string
+		Label string
 	}
 	var data struct {
-		Galleries []Gallery
+		Galleries  []Gallery
+		Sort       string
+		Sorts      []SortOption
+		Tag        string
+		Tags       []string
+		Visibility string
+		// NextURL and FirstURL link to the next and first pages, when the
+		// current page isn't the last or first.
+		NextURL  string
+		FirstURL string
+		Usage    struct {
+			Images    int
+			Size      string
+			MaxImages int
+			MaxSize   string
+			// Percent of the most constrained quota in use, from 0 to 100.
+			// Zero when there is no quota.
+			Percent int
+		}
 	}
 
 	user := context.User(r.Context())
-	galleries, err := g.GalleryService.ByUserID(user.ID)
+	query := r.URL.Query()
+	opts := models.GalleryListOptions{
+		Sort:  query.Get("sort"),
+		Tag:   query.Get("tag"),
+		After: query.Get("after"),
+	}
+	if _, ok := gallerySortLabels[opts.Sort]; !ok {
+		opts.Sort = models.GallerySortNewest
+	}
+	switch query.Get("visibility") {
+	case models.VisibilityPublic, models.VisibilityPrivate:
+		opts.Visibility = query.Get("visibility")
+	}
+	page, err := g.GalleryService.ListByUserID(user.ID, opts)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	for _, gallery := range galleries {
+	data.Sort = opts.Sort
+	for _, sort := range models.GallerySorts {
+		data.Sorts = append(data.Sorts, SortOption{sort, gallerySortLabels[sort]})
+	}
+	data.Tag = opts.Tag
+	data.Visibility = opts.Visibility
+	data.Tags, err = g.GalleryService.TagsByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Page links keep the sort and filters.
+	query.Del("after")
+	if opts.After != "" {
+		data.FirstURL = "/galleries/me?" + query.Encode()
+	}
+	if page.Next != "" {
+		query.Set("after", page.Next)
+		data.NextURL = "/galleries/me?" + query.Encode()
+	}
+
+	usages, err := g.GalleryService.GalleryUsages(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, gallery := range page.Galleries {
+		usage := usages[gallery.ID]
 		data.Galleries = append(data.Galleries, Gallery{
-			ID:    gallery.ID,
-			Title: gallery.Title,
+			ID:        gallery.ID,
+			Title:     gallery.Title,
+			Private:   gallery.Visibility == models.VisibilityPrivate,
+			Images:    usage.Images,
+			Size:      formatBytes(usage.Bytes),
+			UpdatedAt: gallery.UpdatedAt.Format("Jan 2, 2006"),
 		})
 	}
 
+	usage, err := g.GalleryService.UserUsage(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	quota := g.GalleryService.UserQuota
+	data.Usage.Images = usage.Images
+	data.Usage.Size = formatBytes(usage.Bytes)
+	data.Usage.MaxImages = quota.MaxImages
+	if quota.MaxBytes > 0 {
+		data.Usage.MaxSize = formatBytes(quota.MaxBytes)
+		data.Usage.Percent = percent(usage.Bytes, quota.MaxBytes)
+	}
+	if quota.MaxImages > 0 {
+		p := percent(int64(usage.Images), int64(quota.MaxImages))
+		if p > data.Usage.Percent {
+			data.Usage.Percent = p
+		}
+	}
+
 	g.Templates.Index.Execute(w, r, data)
 }
 
@@ -136,8 +453,9 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = g.GalleryService.Delete(gallery.ID)
+	err = g.GalleryService.Trash(gallery.ID)
 	if err != nil {
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
@@ -145,108 +463,516 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/galleries/me", http.StatusFound)
 }
 
-func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryByID(w, r)
+// Duplicate copies a gallery of the current user, with its settings and
+// images, under the title in the form.
+func (g Galleries) Duplicate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
 		return
 	}
+	title := strings.TrimSpace(r.FormValue("title"))
+	if title == "" {
+		title = "Copy of " + gallery.Title
+	}
 
-	type Image struct {
-		GalleryID       int
-		Filename        string
-		FilenameEscaped string
+	duplicate, err := g.GalleryService.Duplicate(gallery.ID, title)
+	if err != nil {
+		var quotaErr models.QuotaError
+		if errors.As(err, &quotaErr) {
+			err = errors.Public(err, "The gallery was not duplicated because it would go over your storage quota.")
+			g.renderEdit(w, r, gallery, editNotice{}, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", duplicate.ID), http.StatusFound)
+}
+
+func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
 	}
+	g.renderShow(w, r, gallery)
+}
+
+func (g Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
 	var data struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Tags        []string
+		Breadcrumbs []breadcrumb
+		CanDownload bool
+		Sizes       []string
+		// Watermarked is set when downloads are watermarked, rather than the
+		// original files.
+		Watermarked bool
+		// Proofing is set for clients who opened the gallery with a share
+		// link, so they can pick favorites.
+		Proofing *proofing
+		// Images is the first page of images, or the page starting at the
+		// cursor in the "from" query parameter.
+		Images imageTiles
 	}
+	var err error
+	access := g.access(r, gallery)
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-	images, err := g.GalleryService.Images(gallery.ID)
+	data.Tags = gallery.Tags
+	data.Breadcrumbs, err = collectionBreadcrumbs(g.CollectionService, gallery.CollectionID, access.Owner)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-	for _, image := range images {
-		data.Images = append(data.Images, Image{
-			GalleryID:       image.GalleryID,
-			Filename:        image.Filename,
-			FilenameEscaped: url.PathEscape(image.Filename),
-		})
+	data.CanDownload = access.Download
+	data.Watermarked = gallery.Watermark && !access.Owner
+	for _, size := range models.ImageSizes {
+		data.Sizes = append(data.Sizes, size.Name)
+	}
+	data.Images, err = g.imageTiles(gallery, access, r.FormValue("from"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
+	data.Proofing = data.Images.Proofing
 
-	g.Templates.Show.Execute(w, r, data)
+	g.Templates.Show.Execute(w, r, data, errs...)
+}
+
+// ShowImages renders the image tiles of a page of a gallery without the rest
+// of the gallery page, starting at the cursor in the "from" query
+// parameter. The gallery page appends them as its visitors scroll down.
+func (g Galleries) ShowImages(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	tiles, err := g.imageTiles(gallery, g.access(r, gallery), r.FormValue("from"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.Templates.ShowImages.Execute(w, r, tiles)
+}
+
+// imageTiles is a page of the images shown on a gallery page.
+type imageTiles struct {
+	GalleryID int
+	Images    []imageTile
+	// CanDownload adds checkboxes to pick the images to download.
+	CanDownload bool
+	Proofing    *proofing
+	// FirstPage is set when the page starts with the first image.
+	FirstPage bool
+	// Next is the cursor of the next page, or empty on the last page.
+	Next string
+}
+
+type imageTile struct {
+	ID        string
+	GalleryID int
+	Version   string
+	Filename  string
+	Caption   string
+	Favorite  bool
+	Note      string
+}
+
+// imageTiles returns the page of the images of a gallery starting at the
+// cursor from, or with the first image if from is empty.
+func (g Galleries) imageTiles(gallery *models.Gallery, access galleryAccess, from string) (imageTiles, error) {
+	tiles := imageTiles{
+		GalleryID:   gallery.ID,
+		CanDownload: access.Download,
+		FirstPage:   from == "",
+	}
+	page, err := g.GalleryService.ImagesPage(gallery.ID, from, models.DefaultImagePageSize)
+	if err != nil {
+		return imageTiles{}, err
+	}
+	tiles.Next = page.Next
+	marks := make(map[string]models.ProofMark)
+	if access.ShareLink != nil {
+		tiles.Proofing, marks, err = g.proofing(access.ShareLink)
+		if err != nil {
+			return imageTiles{}, err
+		}
+	}
+	for _, image := range page.Images {
+		tiles.Images = append(tiles.Images, imageTile{
+			ID:        image.ID,
+			GalleryID: image.GalleryID,
+			Version:   imageVersion(gallery, image),
+			Filename:  image.Filename,
+			Caption:   image.Caption,
+			Favorite:  marks[image.ID].Favorite,
+			Note:      marks[image.ID].Note,
+		})
+	}
+	return tiles, nil
 }
 
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
-	filename := g.filename(w, r)
-	galleryID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, image, err := g.galleryImage(w, r, g.userCanViewGallery)
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusNotFound)
 		return
 	}
 
-	image, err := g.GalleryService.Image(galleryID, filename)
+	if gallery.Watermark {
+		// Owners see the originals at the same URL.
+		w.Header().Add("Vary", "Cookie")
+		if !g.access(r, gallery).Owner {
+			image, err = g.watermarked(gallery, image)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	// WebP images are served as JPEG to browsers that don't ask for WebP, so
+	// caches must key these responses on the Accept header too.
+	if image.ContentType() == "image/webp" {
+		w.Header().Add("Vary", "Accept")
+		format := negotiate(r.Header.Get("Accept"), "image/jpeg", "image/webp")
+		if format != "image/webp" {
+			image, err = g.GalleryService.Fallback(image)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	f, obj, err := g.GalleryService.OpenImage(image)
 	if err != nil {
-		if errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	cacheImage(w, r, gallery, image, image.ETag())
+	w.Header().Set("Content-Disposition", contentDisposition("inline", image.Filename))
+	http.ServeContent(w, r, image.Filename, obj.ModTime, f)
+}
+
+// DownloadImage serves the original file of an image as an attachment, saved
+// under its uploaded filename. Visitors of watermarked galleries get the
+// watermarked version instead.
+func (g Galleries) DownloadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, image, err := g.galleryImage(w, r, g.userCanDownloadGallery)
+	if err != nil {
+		return
+	}
+	if gallery.Watermark {
+		// Owners get the originals at the same URL.
+		w.Header().Add("Vary", "Cookie")
+		if !g.access(r, gallery).Owner {
+			image, err = g.watermarked(gallery, image)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	f, obj, err := g.GalleryService.OpenImage(image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if etag := image.ETag(); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", image.Filename))
+	http.ServeContent(w, r, image.Filename, obj.ModTime, f)
+}
+
+// Download streams a ZIP archive of the images of a gallery. The "image"
+// query parameter, which may be repeated, limits the archive to some of the
+// images, and "size" picks one of models.ImageSizes instead of the originals.
+// Visitors of watermarked galleries get watermarked images.
+func (g Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, g.userCanDownloadGallery)
+	if err != nil {
+		return
+	}
+
+	var size *models.ImageSize
+	if name := r.FormValue("size"); name != "" && name != "original" {
+		s, ok := models.ImageSizeByName(name)
+		if !ok {
+			http.Error(w, "Unknown image size", http.StatusBadRequest)
+			return
+		}
+		size = &s
+	}
+
+	images, err := g.GalleryService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if selected := r.URL.Query()["image"]; len(selected) > 0 {
+		images, err = selectImages(images, selected)
+		if err != nil {
 			http.Error(w, "Image not found", http.StatusNotFound)
 			return
 		}
+	}
+
+	wm, err := g.downloadWatermark(r, gallery)
+	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
-	http.ServeFile(w, r, image.Path)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", archiveFilename(gallery.Title)))
+	err = g.GalleryService.WriteArchive(w, images, size, wm)
+	if err != nil {
+		// Part of the archive has been sent already. Abort the connection so
+		// the client doesn't mistake the truncated archive for a complete one.
+		fmt.Println(err)
+		panic(http.ErrAbortHandler)
+	}
 }
 
+// UploadImage adds the images of a multipart form to a gallery. Each file is
+// streamed straight from the request into storage, and one bad file doesn't
+// stop the others. The outcome of every file is reported back, as JSON to
+// XHR requests and on the edit page otherwise.
 func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
 		return
 	}
 
-	err = r.ParseMultipartForm(5 << 20) // 5mb
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequestSize)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		http.Error(w, "Expected a multipart form", http.StatusBadRequest)
 		return
 	}
-	fileHeaders := r.MultipartForm.File["images"]
-	for _, fileHeader := range fileHeaders {
-		file, err := fileHeader.Open()
+
+	var results []uploadResult
+	status := http.StatusOK
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			http.Error(w, "Something went wrong", http.StatusInternalServerError)
-			return
+			// The request was cut short or went over the size limit, so there
+			// is nothing more to read.
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				status = http.StatusRequestEntityTooLarge
+				results = append(results, uploadResult{
+					Reason: fmt.Sprintf("The upload is larger than %v. Remaining files were not uploaded.", formatBytes(maxUploadRequestSize)),
+				})
+			} else {
+				fmt.Println(err)
+				status = http.StatusBadRequest
+				results = append(results, uploadResult{
+					Reason: "The upload was interrupted. Remaining files were not uploaded.",
+				})
+			}
+			break
+		}
+		if part.FormName() != "images" || part.FileName() == "" {
+			part.Close()
+			continue
 		}
-		defer file.Close()
 
-		err = g.GalleryService.CreateImage(gallery.ID, fileHeader.Filename, file)
+		filename := part.FileName()
+		image, err := g.GalleryService.CreateImageFromStream(gallery.ID, filename, part, maxImageSize)
+		part.Close()
 		if err != nil {
-			var fileErr models.FileError
-			if errors.As(err, &fileErr) {
-				msg := fmt.Sprintf("%v has an invalid content type or extension. Upload only accept jpg, png, and gif files.", fileHeader.Filename)
-				http.Error(w, msg, http.StatusBadRequest)
-				return
+			reason, code := imageUploadError(filename, err)
+			if code == http.StatusInternalServerError {
+				fmt.Println(err)
 			}
-			http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+			results = append(results, uploadResult{
+				Filename: filename,
+				Reason:   reason,
+			})
+			continue
+		}
+		results = append(results, uploadResult{
+			Filename: filename,
+			Accepted: true,
+			ID:       image.ID,
+			SavedAs:  image.Filename,
+		})
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Results []uploadResult `json:"results"`
+		}{results})
+		return
+	}
+	g.renderEdit(w, r, gallery, editNotice{UploadResults: results})
+}
+
+// ImportArchive adds the images in an uploaded ZIP archive to a gallery. Files
+// in the archive that aren't images, or are unsafe, are skipped, and the
+// outcome of every file is reported like UploadImage does.
+func (g Galleries) ImportArchive(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	limits := models.DefaultArchiveLimits
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxArchiveSize+maxFormOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart form", http.StatusBadRequest)
+		return
+	}
+	var archive io.ReadCloser
+	for archive == nil {
+		part, err := mr.NextPart()
+		if err != nil {
+			err = errors.Public(err, "Choose a ZIP archive to import.")
+			g.renderImportError(w, r, gallery, err, http.StatusBadRequest)
 			return
 		}
+		if part.FormName() == "archive" && part.FileName() != "" {
+			archive = part
+			continue
+		}
+		part.Close()
 	}
+	defer archive.Close()
 
-	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	entries, err := g.GalleryService.ImportArchive(gallery.ID, archive, limits)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, models.ErrArchiveTooLarge), errors.As(err, &maxBytesErr):
+			err = errors.Public(err, fmt.Sprintf("The archive is too large. Archives can be up to %v, with up to %d files and %v once extracted.",
+				formatBytes(limits.MaxArchiveSize), limits.MaxEntries, formatBytes(limits.MaxTotalSize)))
+			g.renderImportError(w, r, gallery, err, http.StatusRequestEntityTooLarge)
+		case errors.Is(err, zip.ErrFormat), errors.Is(err, zip.ErrAlgorithm):
+			err = errors.Public(err, "The file is not a ZIP archive, or it is damaged.")
+			g.renderImportError(w, r, gallery, err, http.StatusUnprocessableEntity)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var results []uploadResult
+	for _, entry := range entries {
+		if entry.Err != nil {
+			reason, code := imageUploadError(entry.Name, entry.Err)
+			if code == http.StatusInternalServerError {
+				fmt.Println(entry.Err)
+			}
+			results = append(results, uploadResult{
+				Filename: entry.Name,
+				Reason:   reason,
+			})
+			continue
+		}
+		results = append(results, uploadResult{
+			Filename: entry.Name,
+			Accepted: true,
+			ID:       entry.Image.ID,
+			SavedAs:  entry.Image.Filename,
+		})
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Results []uploadResult `json:"results"`
+		}{results})
+		return
+	}
+	g.renderEdit(w, r, gallery, editNotice{ImportResults: results})
+}
+
+// renderImportError reports an archive that could not be imported at all.
+func (g Galleries) renderImportError(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, err error, status int) {
+	if wantsJSON(r) {
+		// Like the HTML page, only public errors are shown as they are.
+		msg := "Something went wrong."
+		var pubErr interface{ Public() string }
+		if errors.As(err, &pubErr) {
+			msg = pubErr.Public()
+		} else {
+			fmt.Println(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{msg})
+		return
+	}
+	g.renderEdit(w, r, gallery, editNotice{}, err)
+}
+
+// UpdateImage saves the caption and tags of an image.
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	image, err := g.imageByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	image.Caption = r.FormValue("caption")
+	image.Tags = models.ParseTags(r.FormValue("tags"))
+	err = g.GalleryService.UpdateImage(&image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", image.GalleryID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
 func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
-	filename := g.filename(w, r)
 	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
 	if err != nil {
 		return
 	}
-	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	err = g.GalleryService.TrashImage(gallery.ID, chi.URLParam(r, "imageID"))
 	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
@@ -255,6 +981,82 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// Duplicates lists groups of images across the user's galleries that look
+// alike, so they can be reviewed and cleaned up.
+func (g Galleries) Duplicates(w http.ResponseWriter, r *http.Request) {
+	type Image struct {
+		ID        string
+		GalleryID int
+		Version   string
+		Filename  string
+	}
+	var data struct {
+		Groups [][]Image
+	}
+
+	user := context.User(r.Context())
+	groups, err := g.GalleryService.PossibleDuplicates(user.ID, models.DefaultDuplicateDistance)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	galleries, err := g.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	galleryByID := make(map[int]*models.Gallery, len(galleries))
+	for i := range galleries {
+		galleryByID[galleries[i].ID] = &galleries[i]
+	}
+	for _, group := range groups {
+		var images []Image
+		for _, image := range group {
+			var version string
+			if gallery, ok := galleryByID[image.GalleryID]; ok {
+				version = imageVersion(gallery, image)
+			}
+			images = append(images, Image{
+				ID:        image.ID,
+				GalleryID: image.GalleryID,
+				Version:   version,
+				Filename:  image.Filename,
+			})
+		}
+		data.Groups = append(data.Groups, images)
+	}
+
+	g.Templates.Duplicates.Execute(w, r, data)
+}
+
+// formatBytes formats a number of bytes for humans, like "1.5 MB".
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTP"[exp])
+}
+
+// percent returns part as a percentage of total, capped at 100.
+func percent(part, total int64) int {
+	if total <= 0 {
+		return 0
+	}
+	p := int(part * 100 / total)
+	if p > 100 {
+		return 100
+	}
+	return p
+}
+
 // Define gallery functional option
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 
@@ -286,10 +1088,103 @@ func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...g
 	return gallery, nil
 }
 
-func (g Galleries) filename(w http.ResponseWriter, r *http.Request) string {
-	filename := chi.URLParam(r, "filename")
-	filename = filepath.Base(filename)
-	return filename
+// imageByID looks up the image in the URL after checking the gallery it
+// belongs to with opts.
+func (g Galleries) imageByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (models.Image, error) {
+	_, image, err := g.galleryImage(w, r, opts...)
+	return image, err
+}
+
+// galleryImage is like imageByID, also returning the gallery.
+func (g Galleries) galleryImage(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, models.Image, error) {
+	gallery, err := g.galleryByID(w, r, opts...)
+	if err != nil {
+		return nil, models.Image{}, err
+	}
+	image, err := g.GalleryService.Image(gallery.ID, chi.URLParam(r, "imageID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return nil, models.Image{}, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, models.Image{}, err
+	}
+	return gallery, image, nil
+}
+
+// contentDisposition builds a Content-Disposition header value. Filenames
+// that aren't plain ASCII are encoded as described in RFC 6266, so browsers
+// save the file under its original name.
+func contentDisposition(disposition, filename string) string {
+	value := mime.FormatMediaType(disposition, map[string]string{"filename": filename})
+	if value == "" {
+		return disposition
+	}
+	return value
+}
+
+// collectionID reads the "collection_id" form value, checking the collection
+// belongs to the user. Zero means no collection.
+func (g Galleries) collectionID(r *http.Request, userID int) (int, error) {
+	value := r.FormValue("collection_id")
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	collection, err := g.CollectionService.ByID(id)
+	if err != nil {
+		return 0, err
+	}
+	if collection.UserID != userID {
+		return 0, fmt.Errorf("collection %d belongs to another user", id)
+	}
+	return id, nil
+}
+
+// selectImages returns the images with the given IDs, in gallery order. It
+// fails if any of the IDs is not in images.
+func selectImages(images []models.Image, ids []string) ([]models.Image, error) {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var selected []models.Image
+	for _, image := range images {
+		if wanted[image.ID] {
+			selected = append(selected, image)
+			delete(wanted, image.ID)
+		}
+	}
+	if len(wanted) > 0 {
+		return nil, models.ErrNotFound
+	}
+	return selected, nil
+}
+
+// archiveFilename turns a gallery title into a name to save its archive as.
+func archiveFilename(title string) string {
+	return titleFilename(title) + ".zip"
+}
+
+// titleFilename turns a gallery title into a name to save files about it as,
+// without an extension.
+func titleFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '-'
+		}
+		return r
+	}, title)
+	name = strings.Trim(name, " .")
+	if name == "" {
+		name = "gallery"
+	}
+	return name
 }
 
 func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
@@ -1,6 +1,10 @@
 package controllers
 
 import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 
 	"archazid.io/lenslocked/context"
@@ -51,3 +55,64 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireAdmin only lets admins through. Everyone else gets a 404, so the
+// pages don't show up for them.
+func (umw UserMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.Admin {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MultipartCSRF copies the CSRF token of a multipart form into the
+// X-CSRF-Token header. Without it, the CSRF middleware parses the whole form
+// looking for the token, buffering every uploaded file before the handler
+// gets a chance to stream them. Only the first field of the form is checked,
+// which is where csrfField goes in upload forms.
+func MultipartCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get(csrfHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Keep a copy of everything read, and put it back in front of the rest
+		// of the body afterwards so the handler sees the request untouched.
+		var consumed bytes.Buffer
+		body := r.Body
+		mr := multipart.NewReader(io.TeeReader(body, &consumed), params["boundary"])
+		part, err := mr.NextPart()
+		if err == nil && part.FormName() == csrfFieldName {
+			token, err := io.ReadAll(io.LimitReader(part, 1024))
+			if err == nil {
+				r.Header.Set(csrfHeader, string(token))
+			}
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&consumed, body), body}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The header and form field gorilla/csrf reads the token from by default.
+const (
+	csrfHeader    = "X-CSRF-Token"
+	csrfFieldName = "gorilla.csrf.Token"
+)
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// negotiate picks the media type from offers that best matches an Accept
+// header. A type wins when the client gives it a higher quality value, or the
+// same quality value through a more specific media range ("image/webp" is
+// more specific than "image/*", which is more specific than "*/*"). Remaining
+// ties go to the offer listed first, so callers should list the most widely
+// supported type first. An empty string is returned if nothing is acceptable.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+
+	ranges := parseAccept(accept)
+	best := ""
+	bestQ, bestSpecificity := 0.0, -1
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, ar := range ranges {
+			s := ar.matches(offer)
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && specificity > bestSpecificity) {
+			best, bestQ, bestSpecificity = offer, q, specificity
+		}
+	}
+	return best
+}
+
+type acceptRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// matches returns how specifically the range matches the media type: 2 for an
+// exact match, 1 for "type/*", 0 for "*/*" and -1 if it doesn't match.
+func (ar acceptRange) matches(mediaType string) int {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+	switch {
+	case ar.typ == typ && ar.subtype == subtype:
+		return 2
+	case ar.typ == typ && ar.subtype == "*":
+		return 1
+	case ar.typ == "*" && ar.subtype == "*":
+		return 0
+	}
+	return -1
+}
+
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		typ, subtype, ok := strings.Cut(mediaRange, "/")
+		if !ok {
+			continue
+		}
+		ar := acceptRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(key) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(value, 64)
+			if err == nil {
+				ar.q = q
+			}
+		}
+		ranges = append(ranges, ar)
+	}
+	return ranges
+}
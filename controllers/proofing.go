@@ -0,0 +1,264 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// proofing is the state of a client's selection shown on the gallery page.
+type proofing struct {
+	Favorites    int
+	MaxFavorites int
+	Submitted    bool
+}
+
+// proofing returns the selection of a share link, and its marks by image ID.
+func (g Galleries) proofing(link *models.ShareLink) (*proofing, map[string]models.ProofMark, error) {
+	marks, err := g.ProofingService.Marks(link.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := proofing{
+		Favorites:    len(models.Favorites(marks)),
+		MaxFavorites: link.MaxFavorites,
+		Submitted:    link.Submitted(),
+	}
+	byImage := make(map[string]models.ProofMark)
+	for _, mark := range marks {
+		byImage[mark.ImageID] = mark
+	}
+	return &state, byImage, nil
+}
+
+// SetFavorite adds an image to the favorites of the client, or removes it
+// when the "favorite" form value is false.
+func (g Galleries) SetFavorite(w http.ResponseWriter, r *http.Request) {
+	gallery, link, err := g.clientShareLink(w, r)
+	if err != nil {
+		return
+	}
+	imageID := chi.URLParam(r, "imageID")
+	err = g.ProofingService.SetFavorite(link, imageID, r.FormValue("favorite") == "true")
+	if err != nil {
+		g.renderMarkError(w, r, gallery, link, err)
+		return
+	}
+	http.Redirect(w, r, g.imageTileURL(gallery.ID, imageID), http.StatusFound)
+}
+
+// SetNote saves the note of the client on an image.
+func (g Galleries) SetNote(w http.ResponseWriter, r *http.Request) {
+	gallery, link, err := g.clientShareLink(w, r)
+	if err != nil {
+		return
+	}
+	imageID := chi.URLParam(r, "imageID")
+	err = g.ProofingService.SetNote(link, imageID, r.FormValue("note"))
+	if err != nil {
+		g.renderMarkError(w, r, gallery, link, err)
+		return
+	}
+	http.Redirect(w, r, g.imageTileURL(gallery.ID, imageID), http.StatusFound)
+}
+
+// imageTileURL is the gallery page scrolled to the tile of an image. The page
+// starts with the image, which may be past the first page. If the image
+// can't be looked up, the gallery page starts at its first page instead.
+func (g Galleries) imageTileURL(galleryID int, imageID string) string {
+	image, err := g.GalleryService.Image(galleryID, imageID)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err)
+		}
+		return fmt.Sprintf("/galleries/%d#image-%s", galleryID, imageID)
+	}
+	return fmt.Sprintf("/galleries/%d?from=%s#image-%s", galleryID, models.ImageCursor(image), imageID)
+}
+
+func (g Galleries) renderMarkError(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, link *models.ShareLink, err error) {
+	switch {
+	case errors.Is(err, models.ErrSelectionFull):
+		err = errors.Public(err, fmt.Sprintf("You can pick up to %d favorites. Remove one to pick another.", link.MaxFavorites))
+		g.renderShow(w, r, gallery, err)
+	case errors.Is(err, models.ErrSelectionSubmitted):
+		err = errors.Public(err, "Your selection has been submitted and can no longer be changed.")
+		g.renderShow(w, r, gallery, err)
+	case errors.Is(err, models.ErrNotFound):
+		http.Error(w, "Image not found", http.StatusNotFound)
+	default:
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	}
+}
+
+// SubmitSelection locks the selection of the client and emails the owner of
+// the gallery the chosen filenames.
+func (g Galleries) SubmitSelection(w http.ResponseWriter, r *http.Request) {
+	gallery, link, err := g.clientShareLink(w, r)
+	if err != nil {
+		return
+	}
+	err = g.ProofingService.Submit(link)
+	if err != nil {
+		g.renderMarkError(w, r, gallery, link, err)
+		return
+	}
+
+	// The selection is saved either way, so a failed email is only logged.
+	err = g.notifySelection(r, gallery, link)
+	if err != nil {
+		fmt.Println(err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d", gallery.ID), http.StatusFound)
+}
+
+func (g Galleries) notifySelection(r *http.Request, gallery *models.Gallery, link *models.ShareLink) error {
+	owner, err := g.UserService.ByID(gallery.UserID)
+	if err != nil {
+		return err
+	}
+	marks, err := g.ProofingService.Marks(link.ID)
+	if err != nil {
+		return err
+	}
+	var filenames []string
+	for _, mark := range models.Favorites(marks) {
+		filenames = append(filenames, mark.Filename)
+	}
+	client := link.Label
+	if client == "" {
+		client = "A client"
+	}
+	selectionURL := absoluteURL(r, selectionPath(gallery.ID, link.ID))
+	return g.EmailService.SelectionSubmitted(owner.Email, gallery.Title, client, filenames, selectionURL)
+}
+
+// clientShareLink loads the gallery in the URL along with the share link the
+// visitor opened it with. Only clients with a share link have a selection.
+func (g Galleries) clientShareLink(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.ShareLink, error) {
+	gallery, err := g.galleryByID(w, r, g.userCanViewGallery)
+	if err != nil {
+		return nil, nil, err
+	}
+	link := g.access(r, gallery).ShareLink
+	if link == nil {
+		http.Error(w, "Open the gallery with your share link to pick favorites", http.StatusForbidden)
+		return nil, nil, fmt.Errorf("visitor has no share link")
+	}
+	return gallery, link, nil
+}
+
+// Selection shows the owner of a gallery the favorites and notes of the
+// client of a share link, ready to export.
+func (g Galleries) Selection(w http.ResponseWriter, r *http.Request) {
+	gallery, link, marks, err := g.selectionByLinkID(w, r)
+	if err != nil {
+		return
+	}
+
+	var data struct {
+		ID           int
+		Title        string
+		LinkID       int
+		Label        string
+		MaxFavorites int
+		Submitted    bool
+		SubmittedAt  string
+		Favorites    []models.ProofMark
+		// Notes are the notes left on images that weren't picked.
+		Notes     []models.ProofMark
+		Lightroom string
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.LinkID = link.ID
+	data.Label = link.Label
+	data.MaxFavorites = link.MaxFavorites
+	data.Submitted = link.Submitted()
+	if data.Submitted {
+		data.SubmittedAt = link.SubmittedAt.Format("Jan 2, 2006 15:04")
+	}
+	data.Favorites = models.Favorites(marks)
+	for _, mark := range marks {
+		if !mark.Favorite {
+			data.Notes = append(data.Notes, mark)
+		}
+	}
+	data.Lightroom = models.LightroomSearch(marks)
+
+	g.Templates.Selection.Execute(w, r, data)
+}
+
+// SelectionCSV downloads the favorites of the client of a share link as CSV.
+func (g Galleries) SelectionCSV(w http.ResponseWriter, r *http.Request) {
+	gallery, link, marks, err := g.selectionByLinkID(w, r)
+	if err != nil {
+		return
+	}
+
+	filename := titleFilename(gallery.Title) + " selection.csv"
+	if link.Label != "" {
+		filename = titleFilename(gallery.Title+" "+link.Label) + " selection.csv"
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+	err = models.WriteSelectionCSV(w, marks)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// ReopenSelection unlocks a submitted selection so the client can change it.
+func (g Galleries) ReopenSelection(w http.ResponseWriter, r *http.Request) {
+	gallery, link, _, err := g.selectionByLinkID(w, r)
+	if err != nil {
+		return
+	}
+	err = g.ProofingService.Reopen(gallery.ID, link.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, selectionPath(gallery.ID, link.ID), http.StatusFound)
+}
+
+// selectionByLinkID loads the gallery of the current user in the URL, the
+// share link in the URL and the marks of its client.
+func (g Galleries) selectionByLinkID(w http.ResponseWriter, r *http.Request) (*models.Gallery, *models.ShareLink, []models.ProofMark, error) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	linkID, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, nil, nil, err
+	}
+	link, err := g.ShareLinkService.ByID(gallery.ID, linkID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return nil, nil, nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, nil, nil, err
+	}
+	marks, err := g.ProofingService.Marks(link.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, nil, nil, err
+	}
+	return gallery, link, marks, nil
+}
+
+func selectionPath(galleryID, linkID int) string {
+	return fmt.Sprintf("/galleries/%d/share-links/%d/selection", galleryID, linkID)
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+)
+
+// ReuploadImage replaces the file of an image the scrubber found corrupted
+// with the original, uploaded again as the "image" field. Only the exact
+// same file is accepted, since every image using it shares the file.
+func (g Galleries) ReuploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, image, err := g.galleryImage(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+maxFormOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart form", http.StatusBadRequest)
+		return
+	}
+	var part *multipart.Part
+	for {
+		part, err = mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Please choose the original file", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "The upload was interrupted", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "image" && part.FileName() != "" {
+			break
+		}
+		part.Close()
+	}
+	err = g.GalleryService.RepairBlob(image.ContentHash, part)
+	part.Close()
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.Is(err, models.ErrChecksumMismatch):
+			err = errors.Public(err, fmt.Sprintf("%v isn't the same file as the original. Please upload the exact file you uploaded before.", image.Filename))
+			g.renderEdit(w, r, gallery, editNotice{}, err)
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, fmt.Sprintf("The file is larger than %v", formatBytes(maxImageSize)), http.StatusRequestEntityTooLarge)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// Integrity lists the images of every user whose files failed verification,
+// for admins.
+func (g Galleries) Integrity(w http.ResponseWriter, r *http.Request) {
+	type Image struct {
+		ID           string
+		GalleryID    int
+		Filename     string
+		GalleryTitle string
+		OwnerEmail   string
+		Detail       string
+		DetectedAt   string
+	}
+	var data struct {
+		Images []Image
+	}
+	images, err := g.GalleryService.CorruptedImages()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, Image{
+			ID:           image.ID,
+			GalleryID:    image.GalleryID,
+			Filename:     image.Filename,
+			GalleryTitle: image.GalleryTitle,
+			OwnerEmail:   image.OwnerEmail,
+			Detail:       image.Detail,
+			DetectedAt:   image.DetectedAt.Format("Jan 2, 2006 15:04"),
+		})
+	}
+	g.Templates.Integrity.Execute(w, r, data)
+}
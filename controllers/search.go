@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/models"
+)
+
+// Search lists the galleries and images of the current user matching the
+// "q" query parameter.
+func (g Galleries) Search(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	query := r.FormValue("q")
+	results, err := g.GalleryService.Search(user.ID, query, models.DefaultSearchLimit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderSearch(w, r, query, results, false)
+}
+
+// PublicSearch is like Search over the public galleries of every user.
+func (g Galleries) PublicSearch(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("q")
+	results, err := g.GalleryService.SearchPublic(query, models.DefaultSearchLimit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderSearch(w, r, query, results, true)
+}
+
+func (g Galleries) renderSearch(w http.ResponseWriter, r *http.Request, query string, results []models.SearchResult, public bool) {
+	type Result struct {
+		GalleryID    int
+		GalleryTitle string
+		ImageID      string
+		Filename     string
+		Headline     template.HTML
+	}
+	var data struct {
+		Query   string
+		Public  bool
+		Results []Result
+	}
+	data.Query = query
+	data.Public = public
+	for _, result := range results {
+		res := Result{
+			GalleryID:    result.GalleryID,
+			GalleryTitle: result.GalleryTitle,
+			Headline:     highlight(result.Headline),
+		}
+		if result.Image != nil {
+			res.ImageID = result.Image.ID
+			res.Filename = result.Image.Filename
+		}
+		data.Results = append(data.Results, res)
+	}
+
+	g.Templates.Search.Execute(w, r, data)
+}
+
+// highlight escapes a search headline and turns its highlighted words into
+// <mark> elements.
+func highlight(headline string) template.HTML {
+	escaped := template.HTMLEscapeString(headline)
+	escaped = strings.NewReplacer(
+		models.HighlightStart, "<mark>",
+		models.HighlightStop, "</mark>",
+	).Replace(escaped)
+	return template.HTML(escaped)
+}
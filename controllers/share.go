@@ -0,0 +1,250 @@
+package controllers
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// galleryAccess describes what the current visitor may do with a gallery.
+type galleryAccess struct {
+	Owner    bool
+	View     bool
+	Download bool
+	// ShareLink is the link the visitor opened the gallery with, if any.
+	ShareLink *models.ShareLink
+}
+
+// access works out what the current visitor may do with a gallery. Owners
+// may do anything, anyone may view public galleries, and share links grant
+// access to the gallery they belong to.
+func (g Galleries) access(r *http.Request, gallery *models.Gallery) galleryAccess {
+	user := context.User(r.Context())
+	if user != nil && user.ID == gallery.UserID {
+		return galleryAccess{Owner: true, View: true, Download: true}
+	}
+
+	var access galleryAccess
+	if gallery.Visibility == models.VisibilityPublic {
+		access.View = true
+		access.Download = gallery.AllowDownloads
+	}
+	// Share links matter even for public galleries, as they may allow more,
+	// and guests need one to comment.
+	link := g.shareLink(r, gallery)
+	if link != nil {
+		access.View = true
+		access.Download = access.Download || link.AllowDownloads
+		access.ShareLink = link
+	}
+	return access
+}
+
+// shareLink returns the share link the visitor opened the gallery with, or
+// nil if there is none, it has been revoked or has expired, or its password
+// hasn't been entered.
+func (g Galleries) shareLink(r *http.Request, gallery *models.Gallery) *models.ShareLink {
+	if g.ShareLinkService == nil {
+		return nil
+	}
+	key, err := readCookie(r, shareCookieName(gallery.ID))
+	if err != nil {
+		return nil
+	}
+	link, err := g.ShareLinkService.ByAccessKey(key)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrShareLinkLocked) {
+			fmt.Println(err)
+		}
+		return nil
+	}
+	if link.GalleryID != gallery.ID {
+		return nil
+	}
+	return link
+}
+
+func shareCookieName(galleryID int) string {
+	return fmt.Sprintf("share_%d", galleryID)
+}
+
+func (g Galleries) userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !g.access(r, gallery).View {
+		// Private galleries are reported as missing so their IDs don't leak.
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return fmt.Errorf("user does not have access to this gallery")
+	}
+	return nil
+}
+
+func (g Galleries) userCanDownloadGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	access := g.access(r, gallery)
+	if !access.View {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return fmt.Errorf("user does not have access to this gallery")
+	}
+	if !access.Download {
+		http.Error(w, "Downloads are disabled for this gallery", http.StatusForbidden)
+		return fmt.Errorf("user may not download from this gallery")
+	}
+	return nil
+}
+
+// OpenShareLink gives the visitor access to the gallery of a share link and
+// sends them to it. Links with a password ask for it first.
+func (g Galleries) OpenShareLink(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	link, err := g.shareLinkByToken(w, token)
+	if err != nil {
+		return
+	}
+	if link.PasswordHash != "" {
+		g.Templates.Unlock.Execute(w, r, struct{ Token string }{token})
+		return
+	}
+	g.openGallery(w, r, link, g.ShareLinkService.AccessKey(link, token))
+}
+
+// UnlockShareLink checks the password entered for a share link, and gives
+// access to its gallery if it is right.
+func (g Galleries) UnlockShareLink(w http.ResponseWriter, r *http.Request) {
+	token := chi.URLParam(r, "token")
+	link, err := g.shareLinkByToken(w, token)
+	if err != nil {
+		return
+	}
+	key, err := g.ShareLinkService.Unlock(link, token, r.FormValue("password"), clientIP(r))
+	if err != nil {
+		var throttleErr models.ThrottleError
+		switch {
+		case errors.Is(err, models.ErrWrongPassword):
+			err = errors.Public(err, "That password is not right.")
+			g.Templates.Unlock.Execute(w, r, struct{ Token string }{token}, err)
+		case errors.As(err, &throttleErr):
+			seconds := int(math.Ceil(throttleErr.RetryAfter.Seconds()))
+			err = errors.Public(err, fmt.Sprintf("Too many wrong passwords. Try again in %v.",
+				throttleErr.RetryAfter.Round(time.Second)))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusTooManyRequests)
+			g.Templates.Unlock.Execute(w, r, struct{ Token string }{token}, err)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	g.openGallery(w, r, link, key)
+}
+
+// clientIP returns the address a request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g Galleries) shareLinkByToken(w http.ResponseWriter, token string) (*models.ShareLink, error) {
+	link, err := g.ShareLinkService.ByToken(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	return link, nil
+}
+
+// openGallery remembers the access key of a share link and sends the visitor
+// to its gallery.
+func (g Galleries) openGallery(w http.ResponseWriter, r *http.Request, link *models.ShareLink, key string) {
+	cookie := newCookie(shareCookieName(link.GalleryID), key)
+	cookie.Expires = link.ExpiresAt
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d", link.GalleryID), http.StatusFound)
+}
+
+// CreateShareLink adds a share link to a gallery and shows it to the owner.
+// Only a hash of the token is stored, so this is the only time the link can
+// be seen.
+func (g Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	var duration time.Duration
+	if days := r.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid expiry", http.StatusBadRequest)
+			return
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	}
+	link := models.ShareLink{
+		GalleryID:      gallery.ID,
+		Label:          r.FormValue("label"),
+		AllowDownloads: r.FormValue("allow_downloads") == "true",
+	}
+	if value := r.FormValue("max_favorites"); value != "" {
+		link.MaxFavorites, err = strconv.Atoi(value)
+		if err != nil || link.MaxFavorites < 0 {
+			http.Error(w, "Invalid maximum number of favorites", http.StatusBadRequest)
+			return
+		}
+	}
+	err = g.ShareLinkService.Create(&link, r.FormValue("password"), duration)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	g.renderEdit(w, r, gallery, editNotice{
+		ShareLinkURL: absoluteURL(r, "/share/"+link.Token),
+	})
+}
+
+func (g Galleries) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	linkID, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.ShareLinkService.Delete(gallery.ID, linkID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// absoluteURL turns a path into a URL on the host the request was sent to.
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// RequestTransfer asks whoever has the email address in the form to take
+// over a gallery, and emails them a link to accept it. The response is the
+// same whether or not the address has an account, so it can't be used to
+// find out which addresses do.
+func (g Galleries) RequestTransfer(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	// The address is checked before the request replaces any pending
+	// transfer, since an address that can't be emailed can't accept it.
+	address, err := mail.ParseAddress(strings.TrimSpace(r.FormValue("email")))
+	if err != nil {
+		err = errors.Public(err, "Please enter a valid email address.")
+		g.renderEdit(w, r, gallery, editNotice{}, err)
+		return
+	}
+	transfer, err := g.GalleryService.RequestTransfer(gallery.ID, address.Address)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTransferToSelf):
+			err = errors.Public(err, "The gallery is already yours.")
+			g.renderEdit(w, r, gallery, editNotice{}, err)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	acceptURL := absoluteURL(r, "/transfers/"+transfer.Token)
+	err = g.EmailService.GalleryTransfer(transfer.ToEmail, transfer.FromEmail, transfer.GalleryTitle, acceptURL)
+	if err != nil {
+		// Without the email, the transfer can't be accepted.
+		g.GalleryService.CancelTransfer(gallery.ID)
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// CancelTransfer withdraws the pending transfer of a gallery.
+func (g Galleries) CancelTransfer(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.CancelTransfer(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// Transfer shows the recipient of a gallery transfer what they are about to
+// accept.
+func (g Galleries) Transfer(w http.ResponseWriter, r *http.Request) {
+	transfer, err := g.GalleryService.TransferByToken(chi.URLParam(r, "token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This transfer has expired or was canceled", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderTransfer(w, r, transfer)
+}
+
+func (g Galleries) renderTransfer(w http.ResponseWriter, r *http.Request, transfer *models.Transfer, errs ...error) {
+	var data struct {
+		Token        string
+		GalleryTitle string
+		FromEmail    string
+		ToEmail      string
+		ExpiresAt    string
+		// Recipient is set when the current user is the one the gallery is
+		// transferred to.
+		Recipient bool
+	}
+	data.Token = chi.URLParam(r, "token")
+	data.GalleryTitle = transfer.GalleryTitle
+	data.FromEmail = transfer.FromEmail
+	data.ToEmail = transfer.ToEmail
+	data.ExpiresAt = transfer.ExpiresAt.Format("Jan 2, 2006")
+	data.Recipient = context.User(r.Context()).Email == transfer.ToEmail
+	g.Templates.Transfer.Execute(w, r, data, errs...)
+}
+
+// AcceptTransfer makes the current user the owner of the gallery of a
+// transfer sent to them.
+func (g Galleries) AcceptTransfer(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	token := chi.URLParam(r, "token")
+	gallery, err := g.GalleryService.AcceptTransfer(token, user.ID)
+	if err != nil {
+		var quotaErr models.QuotaError
+		switch {
+		case errors.As(err, &quotaErr):
+			transfer, terr := g.GalleryService.TransferByToken(token)
+			if terr != nil {
+				fmt.Println(terr)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+			err = errors.Public(err, "The gallery doesn't fit in your storage quota. Free up some space first.")
+			g.renderTransfer(w, r, transfer, err)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "This transfer has expired or was canceled", http.StatusNotFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+)
+
+// TransformImage serves an image cropped, scaled and encoded as asked for in
+// the query, like "?preset=card" or "?w=800&h=600&fit=cover&gravity=north".
+// Anyone who can see the image can ask for a preset. Other transforms need
+// the "sig" value from SignTransform, so visitors can't make the server
+// render every size they can think of. Like images, transforms can be
+// versioned with "v".
+func (g Galleries) TransformImage(w http.ResponseWriter, r *http.Request) {
+	gallery, image, err := g.galleryImage(w, r, g.userCanViewGallery)
+	if err != nil {
+		return
+	}
+	t, err := models.ParseTransform(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid transform", http.StatusBadRequest)
+		return
+	}
+	access := g.access(r, gallery)
+	if !t.IsPreset() && !access.Owner && !g.GalleryService.VerifyTransform(image.ID, t, r.FormValue("sig")) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	if gallery.Watermark {
+		w.Header().Add("Vary", "Cookie")
+		if !access.Owner {
+			image, err = g.watermarked(gallery, image)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Something went wrong", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	f, err := g.GalleryService.Transformed(image, t)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	filename := strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename)) + "." + t.Format
+	// Renders are named after the image file and the transform.
+	cacheImage(w, r, gallery, image, `"`+filepath.Base(f.Name())+`"`)
+	w.Header().Set("Content-Type", t.ContentType())
+	w.Header().Set("Content-Disposition", contentDisposition("inline", filename))
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
+
+// SignTransform gives the owner of an image the URL of a transform that
+// isn't a preset, with the same query as TransformImage.
+func (g Galleries) SignTransform(w http.ResponseWriter, r *http.Request) {
+	gallery, image, err := g.galleryImage(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	t, err := models.ParseTransform(r.URL.Query())
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidTransform) {
+			http.Error(w, "Invalid transform", http.StatusBadRequest)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	query := t.Encode()
+	if !t.IsPreset() {
+		sig := g.GalleryService.SignTransform(image.ID, t)
+		if sig == "" {
+			http.Error(w, "Only preset transforms are enabled", http.StatusNotImplemented)
+			return
+		}
+		query += "&sig=" + sig
+	}
+	if version := imageVersion(gallery, image); version != "" {
+		query += "&v=" + version
+	}
+	path := fmt.Sprintf("/galleries/%d/images/%s/transform?%s", gallery.ID, image.ID, query)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, absoluteURL(r, path))
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Trash lists the galleries and images the current user deleted, which can
+// be restored until they are purged.
+func (g Galleries) Trash(w http.ResponseWriter, r *http.Request) {
+	type Gallery struct {
+		ID        int
+		Title     string
+		Images    int
+		DeletedAt string
+		PurgeAt   string
+	}
+	type Image struct {
+		ID           string
+		Filename     string
+		GalleryID    int
+		GalleryTitle string
+		DeletedAt    string
+		PurgeAt      string
+	}
+	var data struct {
+		Galleries     []Gallery
+		Images        []Image
+		RetentionDays int
+	}
+
+	user := context.User(r.Context())
+	trash, err := g.GalleryService.TrashByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	retention := g.trashRetention()
+	data.RetentionDays = int(retention / (24 * time.Hour))
+	for _, gallery := range trash.Galleries {
+		data.Galleries = append(data.Galleries, Gallery{
+			ID:        gallery.ID,
+			Title:     gallery.Title,
+			Images:    gallery.Images,
+			DeletedAt: gallery.DeletedAt.Format("Jan 2, 2006"),
+			PurgeAt:   gallery.DeletedAt.Add(retention).Format("Jan 2, 2006"),
+		})
+	}
+	for _, image := range trash.Images {
+		data.Images = append(data.Images, Image{
+			ID:           image.ID,
+			Filename:     image.Filename,
+			GalleryID:    image.GalleryID,
+			GalleryTitle: image.GalleryTitle,
+			DeletedAt:    image.DeletedAt.Format("Jan 2, 2006"),
+			PurgeAt:      image.DeletedAt.Add(retention).Format("Jan 2, 2006"),
+		})
+	}
+
+	g.Templates.Trash.Execute(w, r, data)
+}
+
+func (g Galleries) trashRetention() time.Duration {
+	if g.TrashRetention <= 0 {
+		return models.DefaultTrashRetention
+	}
+	return g.TrashRetention
+}
+
+// TrashedImage serves an image in the trash of the current user, so it can
+// be recognized before it is restored.
+func (g Galleries) TrashedImage(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	image, err := g.GalleryService.TrashedImage(user.ID, chi.URLParam(r, "imageID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	image, err = g.GalleryService.Fallback(image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	f, obj, err := g.GalleryService.OpenImage(image)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Disposition", contentDisposition("inline", image.Filename))
+	http.ServeContent(w, r, image.Filename, obj.ModTime, f)
+}
+
+// RestoreGallery takes a gallery of the current user out of the trash.
+func (g Galleries) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	err = g.GalleryService.RestoreGallery(user.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found in the trash", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", id), http.StatusFound)
+}
+
+// RestoreImage takes an image of the current user out of the trash, back
+// into its gallery.
+func (g Galleries) RestoreImage(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := g.GalleryService.RestoreImage(user.ID, chi.URLParam(r, "imageID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found in the trash", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}
+
+// EmptyTrash deletes for good everything in the trash of the current user.
+func (g Galleries) EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := g.GalleryService.EmptyTrash(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusFound)
+}
@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+)
+
+// Resumable uploads implement the tus 1.0 protocol (https://tus.io) with the
+// creation, termination and expiration extensions. Like every other
+// state-changing request, POST, PATCH and DELETE requests need the CSRF token
+// in the X-CSRF-Token header.
+
+const tusVersion = "1.0.0"
+
+// TusOptions tells tus clients which protocol features are supported.
+func (g Galleries) TusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(g.uploadMaxSize(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload of a file into the gallery. The
+// filename is taken from the "filename" key of the Upload-Metadata header.
+func (g Galleries) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > g.uploadMaxSize() {
+		http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	filename := tusMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+	if filename == "" {
+		http.Error(w, "Upload-Metadata must include a filename", http.StatusBadRequest)
+		return
+	}
+
+	user := context.User(r.Context())
+	upload, err := g.UploadService.Create(user.ID, gallery.ID, filename, length)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/galleries/%d/uploads/%s", gallery.ID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadOffset reports how much of an upload has been received, so the
+// client knows where to resume.
+func (g Galleries) UploadOffset(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchUpload appends a chunk to an upload. Once every byte is received the
+// file is added to the gallery, going through the same checks as regular
+// uploads.
+func (g Galleries) PatchUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+
+	upload, err = g.UploadService.Append(upload.ID, offset, r.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrUploadOffset):
+			http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		case errors.Is(err, models.ErrUploadLocked):
+			http.Error(w, "Upload is locked by another request", http.StatusLocked)
+		case errors.Is(err, models.ErrUploadTooBig):
+			http.Error(w, "Upload exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Upload not found", http.StatusNotFound)
+		case upload != nil:
+			// The connection most likely dropped. The client will ask for the
+			// offset and resume.
+			fmt.Println(err)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			http.Error(w, "Upload interrupted", http.StatusInternalServerError)
+		default:
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if upload.Complete() {
+		ok := g.completeUpload(w, upload)
+		if !ok {
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload aborts an upload and discards the data received so far.
+func (g Galleries) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+	upload, err := g.uploadByID(w, r)
+	if err != nil {
+		return
+	}
+
+	err = g.UploadService.Delete(upload.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload hands a finished upload to the gallery. Only the request
+// that claims the upload does, so a retried request can't store the image
+// twice. The upload is removed either way, since sending the same bytes
+// again would fail the same way. Errors use status codes tus clients don't
+// retry.
+func (g Galleries) completeUpload(w http.ResponseWriter, upload *models.Upload) bool {
+	upload, err := g.UploadService.Claim(upload.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return false
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return false
+	}
+	defer func() {
+		err := g.UploadService.Delete(upload.ID)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	f, err := g.UploadService.Open(upload)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return false
+	}
+	defer f.Close()
+
+	_, err = g.GalleryService.CreateImage(upload.GalleryID, upload.Filename, f)
+	if err != nil {
+		msg, code := imageUploadError(upload.Filename, err)
+		if code == http.StatusInternalServerError {
+			fmt.Println(err)
+		}
+		http.Error(w, msg, code)
+		return false
+	}
+	return true
+}
+
+// uploadByID looks up the upload in the URL, making sure it belongs to the
+// current user and the gallery in the URL.
+func (g Galleries) uploadByID(w http.ResponseWriter, r *http.Request) (*models.Upload, error) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := g.UploadService.ByID(chi.URLParam(r, "uploadID"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	user := context.User(r.Context())
+	if upload.GalleryID != gallery.ID || upload.UserID != user.ID {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, fmt.Errorf("upload belongs to another gallery or user")
+	}
+	return upload, nil
+}
+
+func (g Galleries) uploadMaxSize() int64 {
+	if g.UploadService.MaxSize == 0 {
+		return models.DefaultMaxUploadSize
+	}
+	return g.UploadService.MaxSize
+}
+
+// tusResumable checks the protocol version requested by the client and sets
+// the version header every tus response needs.
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// tusMetadata decodes an Upload-Metadata header, which holds comma separated
+// pairs of a key and a base64 encoded value.
+func tusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
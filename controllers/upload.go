@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+)
+
+const (
+	// Largest image accepted in an upload.
+	maxImageSize = 50 << 20 // 50mb
+	// Largest multipart request accepted, across all of its files.
+	maxUploadRequestSize = 500 << 20 // 500mb
+	// Room for the fields and boundaries of a multipart form around a file.
+	maxFormOverhead = 1 << 20 // 1mb
+)
+
+// uploadResult reports what happened to one file of an upload.
+type uploadResult struct {
+	Filename string `json:"filename"`
+	Accepted bool   `json:"accepted"`
+	// ID and SavedAs are set for accepted files. SavedAs differs from
+	// Filename when the name had to be cleaned up or was already taken.
+	ID      string `json:"id,omitempty"`
+	SavedAs string `json:"saved_as,omitempty"`
+	// Reason explains why the file was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// imageUploadError turns an error from storing an uploaded image into a
+// message that can be shown to the user, along with a fitting status code.
+func imageUploadError(filename string, err error) (string, int) {
+	var fileErr models.FileError
+	var dupErr models.DuplicateImageError
+	var quotaErr models.QuotaError
+	switch {
+	case errors.As(err, &fileErr):
+		return fmt.Sprintf("%v has an invalid content type or extension. Upload only accept jpg, png, gif, and webp files.", filename),
+			http.StatusUnsupportedMediaType
+	case errors.Is(err, models.ErrImageTooLarge):
+		return fmt.Sprintf("%v is larger than %v.", filename, formatBytes(maxImageSize)),
+			http.StatusRequestEntityTooLarge
+	case errors.As(err, &dupErr):
+		return fmt.Sprintf("%v was skipped because it is identical to %v.", dupErr.Filename, dupErr.Existing),
+			http.StatusUnprocessableEntity
+	case errors.As(err, &quotaErr):
+		return fmt.Sprintf("%v was not uploaded because your %v is full.", filename, quotaErr.Scope),
+			http.StatusRequestEntityTooLarge
+	case errors.Is(err, models.ErrUnsafeArchivePath):
+		return fmt.Sprintf("%v was skipped because it is not a regular file inside the archive.", filename),
+			http.StatusUnprocessableEntity
+	case errors.Is(err, models.ErrSuspiciousCompression):
+		return fmt.Sprintf("%v was skipped because it expands far more than an image would.", filename),
+			http.StatusUnprocessableEntity
+	}
+	return fmt.Sprintf("%v could not be uploaded. Something went wrong.", filename), http.StatusInternalServerError
+}
+
+// wantsJSON reports whether a request was made by a script expecting a JSON
+// response rather than a page.
+func wantsJSON(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+	return negotiate(r.Header.Get("Accept"), "text/html", "application/json") == "application/json"
+}
@@ -17,11 +17,13 @@ type Users struct {
 		CheckYourEmail Template
 		ForgotPassword Template
 		ResetPassword  Template
+		Watermark      Template
 	}
 	UserService          *models.UserService
 	SessionService       *models.SessionService
 	EmailService         *models.EmailService
 	PasswordResetService *models.PasswordResetService
+	WatermarkService     *models.WatermarkService
 }
 
 func (u Users) SignUp(w http.ResponseWriter, r *http.Request) {
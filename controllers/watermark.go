@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"archazid.io/lenslocked/context"
+	"archazid.io/lenslocked/errors"
+	"archazid.io/lenslocked/models"
+)
+
+// watermarked returns the version of an image to show visitors of a gallery
+// with watermarking turned on. Images are left as they are until the owner
+// sets up their watermark.
+func (g Galleries) watermarked(gallery *models.Gallery, image models.Image) (models.Image, error) {
+	wm, err := g.WatermarkService.ByUserID(gallery.UserID)
+	if err != nil {
+		return models.Image{}, err
+	}
+	if !wm.Enabled() {
+		return image, nil
+	}
+	return g.GalleryService.Watermarked(image, wm)
+}
+
+// downloadWatermark returns the watermark to draw over the images of a
+// gallery downloaded by the current visitor, or nil if they get the
+// originals. Like images shown in the gallery, only the owner gets the
+// originals of a watermarked gallery.
+func (g Galleries) downloadWatermark(r *http.Request, gallery *models.Gallery) (*models.Watermark, error) {
+	if !gallery.Watermark || g.access(r, gallery).Owner {
+		return nil, nil
+	}
+	wm, err := g.WatermarkService.ByUserID(gallery.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !wm.Enabled() {
+		return nil, nil
+	}
+	return &wm, nil
+}
+
+// Watermark shows the watermark settings of the current user.
+func (u Users) Watermark(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	wm, err := u.WatermarkService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderWatermark(w, r, wm)
+}
+
+func (u Users) renderWatermark(w http.ResponseWriter, r *http.Request, wm models.Watermark, errs ...error) {
+	var data struct {
+		Text      string
+		HasLogo   bool
+		Position  string
+		Positions []string
+		// Opacity and Scale are percentages.
+		Opacity int
+		Scale   int
+		Enabled bool
+	}
+	data.Text = wm.Text
+	data.HasLogo = len(wm.Logo) > 0
+	data.Position = wm.Position
+	data.Positions = models.WatermarkPositions
+	data.Opacity = int(wm.Opacity*100 + 0.5)
+	data.Scale = int(wm.Scale*100 + 0.5)
+	data.Enabled = wm.Enabled()
+
+	u.Templates.Watermark.Execute(w, r, data, errs...)
+}
+
+// ProcessWatermark saves the watermark settings of the current user. A new
+// logo replaces the old one, which can also be removed to fall back to text.
+func (u Users) ProcessWatermark(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	r.Body = http.MaxBytesReader(w, r.Body, models.MaxWatermarkLogoSize+maxFormOverhead)
+	err := r.ParseMultipartForm(models.MaxWatermarkLogoSize + maxFormOverhead)
+	if err != nil {
+		http.Error(w, "The logo is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	wm, err := u.WatermarkService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	wm.Text = r.FormValue("text")
+	wm.Position = r.FormValue("position")
+	opacity, err := strconv.Atoi(r.FormValue("opacity"))
+	if err == nil {
+		wm.Opacity = float64(opacity) / 100
+	}
+	scale, err := strconv.Atoi(r.FormValue("scale"))
+	if err == nil {
+		wm.Scale = float64(scale) / 100
+	}
+	if r.FormValue("remove_logo") == "true" {
+		wm.Logo = nil
+	}
+	file, _, err := r.FormFile("logo")
+	if err == nil {
+		defer file.Close()
+		wm.Logo, err = io.ReadAll(file)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = u.WatermarkService.Update(wm)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidWatermark) {
+			err = errors.Public(err, "Please upload the logo as a PNG file under 1 MB and 4096×4096 pixels, and keep opacity and size between 1% and 100%.")
+			u.renderWatermark(w, r, wm, err)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me/watermark", http.StatusFound)
+}
+
+// WatermarkPreview shows the watermark of the current user over a sample
+// image.
+func (u Users) WatermarkPreview(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	wm, err := u.WatermarkService.ByUserID(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	err = models.WatermarkPreview(w, wm)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
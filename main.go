@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"archazid.io/lenslocked/controllers"
 	"archazid.io/lenslocked/migrations"
@@ -17,8 +18,38 @@ import (
 )
 
 type config struct {
-	PSQL models.PostgresConfig
-	SMTP models.SMTPConfig
+	PSQL    models.PostgresConfig
+	SMTP    models.SMTPConfig
+	Storage models.StorageConfig
+	// Directory where partial resumable uploads are kept.
+	UploadDir string
+	// TrashRetention is how long deleted galleries and images are kept
+	// before they are purged.
+	TrashRetention time.Duration
+	Transform      struct {
+		// Key signs transform URLs that aren't presets. If empty, only
+		// presets are served.
+		Key string
+		// CacheDir is where rendered transforms are kept, up to CacheBytes.
+		CacheDir   string
+		CacheBytes int64
+	}
+	// Reconcile is how often the database is compared with image storage,
+	// and whether the problems found are repaired.
+	Reconcile struct {
+		Interval time.Duration
+		Repair   bool
+	}
+	// Scrub is how often every stored file is verified against its
+	// checksum, and how fast files are read to do so.
+	Scrub struct {
+		Interval       time.Duration
+		BytesPerSecond int64
+	}
+	Quota struct {
+		User    models.Quota
+		Gallery models.Quota
+	}
 	CSRF struct {
 		Key    string
 		Secure bool
@@ -48,6 +79,82 @@ func loadEnvConfig() (config, error) {
 	cfg.SMTP.Username = os.Getenv("SMTP_USERNAME")
 	cfg.SMTP.Password = os.Getenv("SMTP_PASSWORD")
 
+	cfg.Storage.Backend = os.Getenv("STORAGE_BACKEND")
+	cfg.Storage.Dir = os.Getenv("STORAGE_DIR")
+	cfg.Storage.S3.Endpoint = os.Getenv("S3_ENDPOINT")
+	cfg.Storage.S3.Region = os.Getenv("S3_REGION")
+	cfg.Storage.S3.Bucket = os.Getenv("S3_BUCKET")
+	cfg.Storage.S3.AccessKeyID = os.Getenv("S3_ACCESS_KEY_ID")
+	cfg.Storage.S3.SecretAccessKey = os.Getenv("S3_SECRET_ACCESS_KEY")
+
+	cfg.UploadDir = os.Getenv("UPLOAD_DIR")
+
+	retentionDays, err := envInt("TRASH_RETENTION_DAYS")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.TrashRetention = models.DefaultTrashRetention
+	if retentionDays > 0 {
+		cfg.TrashRetention = time.Duration(retentionDays) * 24 * time.Hour
+	}
+
+	// Reconciliation runs daily unless set to 0 hours, and only reports
+	// problems unless RECONCILE_REPAIR is set.
+	cfg.Reconcile.Interval = 24 * time.Hour
+	if os.Getenv("RECONCILE_INTERVAL_HOURS") != "" {
+		hours, err := envInt("RECONCILE_INTERVAL_HOURS")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Reconcile.Interval = time.Duration(hours) * time.Hour
+	}
+	cfg.Reconcile.Repair = os.Getenv("RECONCILE_REPAIR") == "true"
+
+	// Scrubbing goes through every file in 30 days unless set to 0 days.
+	cfg.Scrub.Interval = models.DefaultScrubInterval
+	if os.Getenv("SCRUB_INTERVAL_DAYS") != "" {
+		days, err := envInt("SCRUB_INTERVAL_DAYS")
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Scrub.Interval = time.Duration(days) * 24 * time.Hour
+	}
+	cfg.Scrub.BytesPerSecond, err = envInt64("SCRUB_BYTES_PER_SECOND")
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.Scrub.BytesPerSecond <= 0 {
+		cfg.Scrub.BytesPerSecond = models.DefaultScrubRate
+	}
+
+	cfg.Transform.Key = os.Getenv("TRANSFORM_KEY")
+	cfg.Transform.CacheDir = os.Getenv("RENDER_CACHE_DIR")
+	if cfg.Transform.CacheDir == "" {
+		cfg.Transform.CacheDir = "renders"
+	}
+	cfg.Transform.CacheBytes, err = envInt64("RENDER_CACHE_BYTES")
+	if err != nil {
+		return cfg, err
+	}
+
+	// Quotas are optional, an unset or zero value means no limit.
+	cfg.Quota.User.MaxBytes, err = envInt64("USER_QUOTA_BYTES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Quota.User.MaxImages, err = envInt("USER_QUOTA_IMAGES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Quota.Gallery.MaxBytes, err = envInt64("GALLERY_QUOTA_BYTES")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Quota.Gallery.MaxImages, err = envInt("GALLERY_QUOTA_IMAGES")
+	if err != nil {
+		return cfg, err
+	}
+
 	// TODO: Read the CSRF values from an ENV variable
 	cfg.CSRF.Key = "gFvi45R4fy5xNBlnEeZtQbfAVCYEIAUX"
 	cfg.CSRF.Secure = false
@@ -58,6 +165,24 @@ func loadEnvConfig() (config, error) {
 	return cfg, nil
 }
 
+// envInt reads an optional integer from an ENV variable.
+func envInt(key string) (int, error) {
+	n, err := envInt64(key)
+	return int(n), err
+}
+
+func envInt64(key string) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return n, nil
+}
+
 func main() {
 	cfg, err := loadEnvConfig()
 	if err != nil {
@@ -87,9 +212,103 @@ func main() {
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	storage, err := models.NewStorage(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
 	galleryService := &models.GalleryService{
+		DB:           db,
+		Storage:      storage,
+		UserQuota:    cfg.Quota.User,
+		GalleryQuota: cfg.Quota.Gallery,
+		RenderCache: &models.RenderCache{
+			Dir:      cfg.Transform.CacheDir,
+			MaxBytes: cfg.Transform.CacheBytes,
+		},
+		TransformKey: []byte(cfg.Transform.Key),
+	}
+	// Move images uploaded before blob storage existed. This is a no-op once
+	// every image has been imported. A failure is logged rather than stopping
+	// the app, and "go run ./cmd/blobs import" retries it.
+	_, err = galleryService.ImportLegacyImages()
+	if err != nil {
+		fmt.Println(err)
+	}
+	uploadService := &models.UploadService{
+		DB:  db,
+		Dir: cfg.UploadDir,
+	}
+	shareLinkService := &models.ShareLinkService{
+		DB: db,
+	}
+	collectionService := &models.CollectionService{
+		DB: db,
+	}
+	commentService := &models.CommentService{
+		DB: db,
+	}
+	proofingService := &models.ProofingService{
+		DB: db,
+	}
+	watermarkService := &models.WatermarkService{
 		DB: db,
 	}
+	// Periodically purge the trash, delete image files no gallery refers to
+	// anymore, uploads that were abandoned, and wrong share link passwords
+	// that no longer count.
+	go func() {
+		for range time.Tick(time.Hour) {
+			_, err := galleryService.PurgeTrash(cfg.TrashRetention)
+			if err != nil {
+				fmt.Println(err)
+			}
+			_, err = galleryService.CollectGarbage(models.DefaultBlobGracePeriod)
+			if err != nil {
+				fmt.Println(err)
+			}
+			err = uploadService.DeleteExpired()
+			if err != nil {
+				fmt.Println(err)
+			}
+			err = shareLinkService.DeleteOldUnlockFailures()
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}()
+	// Keep verifying stored files in the background, a batch at a time, and
+	// wait a while once they are all verified.
+	if cfg.Scrub.Interval > 0 {
+		go func() {
+			for {
+				report, err := galleryService.Scrub(cfg.Scrub.Interval, 100, cfg.Scrub.BytesPerSecond)
+				if err != nil {
+					fmt.Println(err)
+				}
+				for _, failure := range report.Failures {
+					fmt.Printf("scrub: %s: %s\n", failure.Key, failure.Detail)
+				}
+				if err != nil || report.Checked == 0 {
+					time.Sleep(time.Hour)
+				}
+			}
+		}()
+	}
+	// Periodically compare the database with image storage.
+	if cfg.Reconcile.Interval > 0 {
+		go func() {
+			for range time.Tick(cfg.Reconcile.Interval) {
+				report, err := galleryService.Reconcile(cfg.Reconcile.Repair)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				for _, problem := range report.Problems {
+					fmt.Println("reconcile:", problem)
+				}
+			}
+		}()
+	}
 
 	// Setup CSRF middleware
 	csrfMw := csrf.Protect(
@@ -109,6 +328,7 @@ func main() {
 		SessionService:       sessionService,
 		EmailService:         emailService,
 		PasswordResetService: pwResetService,
+		WatermarkService:     watermarkService,
 	}
 	usersC.Templates.SignUp = views.Must(views.ParseFS(
 		templates.FS, "base.tmpl", "users/signup.tmpl"))
@@ -120,8 +340,19 @@ func main() {
 		templates.FS, "base.tmpl", "users/forgot-pw.tmpl"))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(
 		templates.FS, "base.tmpl", "users/reset-pw.tmpl"))
+	usersC.Templates.Watermark = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "users/watermark.tmpl"))
 	galleriesC := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:    galleryService,
+		UploadService:     uploadService,
+		ShareLinkService:  shareLinkService,
+		CollectionService: collectionService,
+		CommentService:    commentService,
+		UserService:       userService,
+		EmailService:      emailService,
+		ProofingService:   proofingService,
+		WatermarkService:  watermarkService,
+		TrashRetention:    cfg.TrashRetention,
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(
 		templates.FS, "base.tmpl", "galleries/new.tmpl"))
@@ -130,11 +361,43 @@ func main() {
 	galleriesC.Templates.Index = views.Must(views.ParseFS(
 		templates.FS, "base.tmpl", "galleries/index.tmpl"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(
-		templates.FS, "base.tmpl", "galleries/show.tmpl"))
+		templates.FS, "base.tmpl", "galleries/show.tmpl", "galleries/images.tmpl"))
+	galleriesC.Templates.ShowImages = views.Must(views.ParseFS(
+		templates.FS, "galleries/images.tmpl"))
+	galleriesC.Templates.Duplicates = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/duplicates.tmpl"))
+	galleriesC.Templates.Search = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/search.tmpl"))
+	galleriesC.Templates.Comments = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/comments.tmpl"))
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/unlock.tmpl"))
+	galleriesC.Templates.Selection = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/selection.tmpl"))
+	galleriesC.Templates.Trash = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/trash.tmpl"))
+	galleriesC.Templates.Integrity = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/integrity.tmpl"))
+	galleriesC.Templates.Transfer = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "galleries/transfer.tmpl"))
+
+	collectionsC := controllers.Collections{
+		CollectionService: collectionService,
+		GalleryService:    galleryService,
+	}
+	collectionsC.Templates.New = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "collections/new.tmpl"))
+	collectionsC.Templates.Edit = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "collections/edit.tmpl"))
+	collectionsC.Templates.Index = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "collections/index.tmpl"))
+	collectionsC.Templates.Show = views.Must(views.ParseFS(
+		templates.FS, "base.tmpl", "collections/show.tmpl"))
 
 	// Setup our router
 	r := chi.NewRouter()
 	// Apply middleware
+	r.Use(controllers.MultipartCSRF)
 	r.Use(csrfMw)
 	r.Use(umw.SetUser)
 
@@ -159,11 +422,46 @@ func main() {
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Get("/watermark", usersC.Watermark)
+		r.Post("/watermark", usersC.ProcessWatermark)
+		r.Get("/watermark/preview", usersC.WatermarkPreview)
+	})
+	// Trash
+	r.Route("/trash", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", galleriesC.Trash)
+		r.Post("/empty", galleriesC.EmptyTrash)
+		r.Post("/galleries/{id}/restore", galleriesC.RestoreGallery)
+		r.Get("/images/{imageID}", galleriesC.TrashedImage)
+		r.Post("/images/{imageID}/restore", galleriesC.RestoreImage)
+	})
+	// Transfers
+	r.Route("/transfers/{token}", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", galleriesC.Transfer)
+		r.Post("/", galleriesC.AcceptTransfer)
+	})
+	// Admin
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RequireAdmin)
+		r.Get("/integrity", galleriesC.Integrity)
 	})
 	// Galleries
+	r.Get("/share/{token}", galleriesC.OpenShareLink)
+	r.Post("/share/{token}", galleriesC.UnlockShareLink)
+	r.Get("/search", galleriesC.PublicSearch)
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesC.Show)
-		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images", galleriesC.ShowImages)
+		r.Get("/{id}/download", galleriesC.Download)
+		r.Get("/{id}/images/{imageID}", galleriesC.Image)
+		r.Get("/{id}/images/{imageID}/download", galleriesC.DownloadImage)
+		r.Get("/{id}/images/{imageID}/transform", galleriesC.TransformImage)
+		r.Get("/{id}/images/{imageID}/comments", galleriesC.Comments)
+		r.Post("/{id}/images/{imageID}/comments", galleriesC.CreateComment)
+		r.Post("/{id}/images/{imageID}/favorite", galleriesC.SetFavorite)
+		r.Post("/{id}/images/{imageID}/note", galleriesC.SetNote)
+		r.Post("/{id}/selection", galleriesC.SubmitSelection)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
 			r.Get("/new", galleriesC.New)
@@ -171,9 +469,43 @@ func main() {
 			r.Get("/{id}/edit", galleriesC.Edit)
 			r.Post("/{id}", galleriesC.Update)
 			r.Get("/me", galleriesC.Index)
+			r.Get("/duplicates", galleriesC.Duplicates)
+			r.Get("/search", galleriesC.Search)
 			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/duplicate", galleriesC.Duplicate)
+			r.Post("/{id}/transfer", galleriesC.RequestTransfer)
+			r.Post("/{id}/transfer/cancel", galleriesC.CancelTransfer)
 			r.Post("/{id}/images", galleriesC.UploadImage)
-			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			r.Post("/{id}/import", galleriesC.ImportArchive)
+			r.Post("/{id}/images/{imageID}", galleriesC.UpdateImage)
+			r.Post("/{id}/images/{imageID}/culling", galleriesC.UpdateCulling)
+			r.Get("/{id}/images/{imageID}/transform/sign", galleriesC.SignTransform)
+			r.Post("/{id}/images/bulk", galleriesC.BulkImages)
+			r.Post("/{id}/images/{imageID}/delete", galleriesC.DeleteImage)
+			r.Post("/{id}/images/{imageID}/reupload", galleriesC.ReuploadImage)
+			r.Post("/{id}/share-links", galleriesC.CreateShareLink)
+			r.Post("/{id}/share-links/{linkID}/delete", galleriesC.DeleteShareLink)
+			r.Get("/{id}/share-links/{linkID}/selection", galleriesC.Selection)
+			r.Get("/{id}/share-links/{linkID}/selection.csv", galleriesC.SelectionCSV)
+			r.Post("/{id}/share-links/{linkID}/selection/reopen", galleriesC.ReopenSelection)
+			r.Post("/{id}/comments/{commentID}/moderate", galleriesC.ModerateComment)
+			r.Options("/{id}/uploads", galleriesC.TusOptions)
+			r.Post("/{id}/uploads", galleriesC.CreateUpload)
+			r.Head("/{id}/uploads/{uploadID}", galleriesC.UploadOffset)
+			r.Patch("/{id}/uploads/{uploadID}", galleriesC.PatchUpload)
+			r.Delete("/{id}/uploads/{uploadID}", galleriesC.DeleteUpload)
+		})
+	})
+	r.Route("/collections", func(r chi.Router) {
+		r.Get("/{id}", collectionsC.Show)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/new", collectionsC.New)
+			r.Post("/", collectionsC.Create)
+			r.Get("/me", collectionsC.Index)
+			r.Get("/{id}/edit", collectionsC.Edit)
+			r.Post("/{id}", collectionsC.Update)
+			r.Post("/{id}/delete", collectionsC.Delete)
 		})
 	})
 
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE blobs (
+    hash TEXT PRIMARY KEY,
+    size BIGINT NOT NULL,
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    unreferenced_at TIMESTAMPTZ
+);
+CREATE INDEX blobs_unreferenced_idx ON blobs (unreferenced_at) WHERE ref_count = 0;
+-- Images uploaded before blobs existed get their blob when they are imported
+-- at startup (or with `go run ./cmd/blobs import`), so existing rows can't be
+-- checked yet.
+ALTER TABLE images
+    ADD CONSTRAINT images_content_hash_fkey
+    FOREIGN KEY (content_hash) REFERENCES blobs (hash) NOT VALID;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images DROP CONSTRAINT images_content_hash_fkey;
+DROP TABLE blobs;
+-- +goose StatementEnd
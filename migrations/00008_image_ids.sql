@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images ADD COLUMN public_id TEXT;
+UPDATE images SET public_id = substr(md5(random()::text || clock_timestamp()::text || id::text), 1, 16);
+ALTER TABLE images ALTER COLUMN public_id SET NOT NULL;
+ALTER TABLE images ADD CONSTRAINT images_public_id_key UNIQUE (public_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images DROP COLUMN public_id;
+-- +goose StatementEnd
@@ -0,0 +1,38 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE images
+    ADD COLUMN caption TEXT NOT NULL DEFAULT '',
+    ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+-- array_to_string is only STABLE, as it can call the output function of any
+-- element type, which keeps it out of generated columns. For text it is
+-- immutable.
+CREATE FUNCTION tags_to_text(tags TEXT[]) RETURNS TEXT
+    LANGUAGE SQL IMMUTABLE PARALLEL SAFE
+    AS $$ SELECT array_to_string(tags, ' ') $$;
+
+-- Titles and captions are stemmed as English, while tags and filenames are
+-- matched as written. Filenames are split on punctuation so "IMG_0042.jpg"
+-- matches "0042".
+ALTER TABLE galleries ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('simple', tags_to_text(tags)), 'B')
+) STORED;
+ALTER TABLE images ADD COLUMN search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', tags_to_text(tags)), 'B') ||
+    setweight(to_tsvector('english', caption), 'C') ||
+    setweight(to_tsvector('simple', regexp_replace(filename, '[^[:alnum:]]+', ' ', 'g')), 'D')
+) STORED;
+
+CREATE INDEX galleries_search_idx ON galleries USING GIN (search);
+CREATE INDEX images_search_idx ON images USING GIN (search);
+CREATE INDEX galleries_tags_idx ON galleries USING GIN (tags);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images DROP COLUMN search, DROP COLUMN caption, DROP COLUMN tags;
+ALTER TABLE galleries DROP COLUMN search, DROP COLUMN tags;
+DROP FUNCTION tags_to_text;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE collections (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- Deleting a collection deletes its sub-collections, but galleries are
+    -- only taken out of them.
+    parent_id INT REFERENCES collections (id) ON DELETE CASCADE,
+    title TEXT NOT NULL,
+    visibility TEXT NOT NULL DEFAULT 'public'
+        CHECK (visibility IN ('public', 'private')),
+    cover_image_id TEXT REFERENCES images (public_id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (parent_id <> id)
+);
+CREATE INDEX collections_user_id_idx ON collections (user_id);
+CREATE INDEX collections_parent_id_idx ON collections (parent_id);
+
+ALTER TABLE galleries
+    ADD COLUMN collection_id INT REFERENCES collections (id) ON DELETE SET NULL;
+CREATE INDEX galleries_collection_id_idx ON galleries (collection_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN collection_id;
+DROP TABLE collections;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE galleries ADD COLUMN comments_require_approval BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE comments (
+    id SERIAL PRIMARY KEY,
+    image_id INT NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    parent_id INT REFERENCES comments (id) ON DELETE CASCADE,
+    -- Comments are written either by a signed in user, or by a guest using a
+    -- share link, who only gives a name.
+    user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    share_link_id INT REFERENCES share_links (id) ON DELETE SET NULL,
+    author_name TEXT NOT NULL,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'visible'
+        CHECK (status IN ('visible', 'pending', 'hidden')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX comments_image_id_idx ON comments (image_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE comments;
+ALTER TABLE galleries DROP COLUMN comments_require_approval;
+-- +goose StatementEnd
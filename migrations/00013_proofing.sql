@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE share_links
+    ADD COLUMN password_hash TEXT,
+    ADD COLUMN max_favorites INT NOT NULL DEFAULT 0,
+    ADD COLUMN submitted_at TIMESTAMPTZ;
+
+CREATE TABLE proof_marks (
+    share_link_id INT NOT NULL REFERENCES share_links (id) ON DELETE CASCADE,
+    image_id INT NOT NULL REFERENCES images (id) ON DELETE CASCADE,
+    favorite BOOLEAN NOT NULL DEFAULT FALSE,
+    note TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (share_link_id, image_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE proof_marks;
+ALTER TABLE share_links
+    DROP COLUMN password_hash,
+    DROP COLUMN max_favorites,
+    DROP COLUMN submitted_at;
+-- +goose StatementEnd
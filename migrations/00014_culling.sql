@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE images
+    ADD COLUMN rating SMALLINT NOT NULL DEFAULT 0
+        CHECK (rating BETWEEN 0 AND 5),
+    ADD COLUMN flag TEXT NOT NULL DEFAULT ''
+        CHECK (flag IN ('', 'pick', 'reject')),
+    ADD COLUMN color_label TEXT NOT NULL DEFAULT ''
+        CHECK (color_label IN ('', 'red', 'yellow', 'green', 'blue', 'purple'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE images
+    DROP COLUMN rating,
+    DROP COLUMN flag,
+    DROP COLUMN color_label;
+-- +goose StatementEnd
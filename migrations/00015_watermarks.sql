@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE watermarks (
+    user_id INT PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    text TEXT NOT NULL DEFAULT '',
+    logo BYTEA,
+    position TEXT NOT NULL DEFAULT 'bottom-right'
+        CHECK (position IN ('center', 'top-left', 'top-right', 'bottom-left', 'bottom-right', 'tiled')),
+    opacity REAL NOT NULL DEFAULT 0.5 CHECK (opacity > 0 AND opacity <= 1),
+    scale REAL NOT NULL DEFAULT 0.25 CHECK (scale > 0 AND scale <= 1)
+);
+
+ALTER TABLE galleries ADD COLUMN watermark BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries DROP COLUMN watermark;
+DROP TABLE watermarks;
+-- +goose StatementEnd
@@ -0,0 +1,38 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Admins see the integrity problems of every user. Grant it with
+-- UPDATE users SET admin = true WHERE email = '...';
+ALTER TABLE users ADD COLUMN admin BOOLEAN NOT NULL DEFAULT false;
+-- Blobs are named after the SHA-256 of their contents, which is their
+-- checksum. Variants record theirs when they are stored.
+ALTER TABLE blobs ADD COLUMN verified_at TIMESTAMPTZ;
+CREATE INDEX blobs_verified_at_idx ON blobs (verified_at NULLS FIRST);
+CREATE TABLE variants (
+    key TEXT PRIMARY KEY,
+    hash TEXT NOT NULL,
+    checksum TEXT NOT NULL,
+    size BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    verified_at TIMESTAMPTZ
+);
+CREATE INDEX variants_hash_idx ON variants (hash);
+CREATE INDEX variants_verified_at_idx ON variants (verified_at NULLS FIRST);
+CREATE TABLE scrub_failures (
+    id SERIAL PRIMARY KEY,
+    key TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    detail TEXT NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX scrub_failures_unresolved_idx ON scrub_failures (key) WHERE resolved_at IS NULL;
+CREATE INDEX scrub_failures_hash_idx ON scrub_failures (hash) WHERE resolved_at IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE scrub_failures;
+DROP TABLE variants;
+ALTER TABLE blobs DROP COLUMN verified_at;
+ALTER TABLE users DROP COLUMN admin;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A gallery has at most one pending transfer, a new request replaces it.
+CREATE TABLE gallery_transfers (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT UNIQUE NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    from_user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    to_user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE gallery_transfers;
+-- +goose StatementEnd
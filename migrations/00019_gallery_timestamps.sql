@@ -0,0 +1,49 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries that existed before get the time of the migration.
+ALTER TABLE galleries
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX galleries_user_created_idx ON galleries (user_id, created_at DESC, id DESC) WHERE deleted_at IS NULL;
+CREATE INDEX galleries_user_updated_idx ON galleries (user_id, updated_at DESC, id DESC) WHERE deleted_at IS NULL;
+CREATE INDEX galleries_user_title_idx ON galleries (user_id, lower(coalesce(title, '')), id) WHERE deleted_at IS NULL;
+
+-- A gallery is updated when its settings change, and when images are added
+-- to it, removed or edited. Culling doesn't count.
+CREATE FUNCTION touch_gallery() RETURNS trigger AS $$
+BEGIN
+    NEW.updated_at = now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER galleries_touch
+    BEFORE UPDATE ON galleries
+    FOR EACH ROW
+    WHEN (OLD.updated_at = NEW.updated_at)
+    EXECUTE FUNCTION touch_gallery();
+
+CREATE FUNCTION touch_image_gallery() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        UPDATE galleries SET updated_at = now() WHERE id = OLD.gallery_id;
+    END IF;
+    IF TG_OP <> 'DELETE' AND (TG_OP = 'INSERT' OR NEW.gallery_id <> OLD.gallery_id) THEN
+        UPDATE galleries SET updated_at = now() WHERE id = NEW.gallery_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER images_touch_gallery
+    AFTER INSERT OR DELETE OR UPDATE OF gallery_id, filename, caption, tags, deleted_at ON images
+    FOR EACH ROW
+    EXECUTE FUNCTION touch_image_gallery();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER images_touch_gallery ON images;
+DROP FUNCTION touch_image_gallery;
+DROP TRIGGER galleries_touch ON galleries;
+DROP FUNCTION touch_gallery;
+ALTER TABLE galleries DROP COLUMN created_at, DROP COLUMN updated_at;
+-- +goose StatementEnd
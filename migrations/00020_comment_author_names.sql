@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Comments of signed in users used to be signed with their email address,
+-- which every visitor of the gallery could see. Only the part before the @ is
+-- kept.
+UPDATE comments c
+SET author_name = split_part(u.email, '@', 1)
+FROM users u
+WHERE c.user_id = u.id AND c.author_name = u.email;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- The addresses are not put back.
+SELECT 1;
+-- +goose StatementEnd
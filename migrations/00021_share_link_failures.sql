@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE share_link_failures (
+    id SERIAL PRIMARY KEY,
+    share_link_id INT NOT NULL REFERENCES share_links (id) ON DELETE CASCADE,
+    ip TEXT NOT NULL,
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX share_link_failures_share_link_id_idx ON share_link_failures (share_link_id, failed_at);
+CREATE INDEX share_link_failures_ip_idx ON share_link_failures (ip, failed_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE share_link_failures;
+-- +goose StatementEnd
@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Transfers are addressed to an email address rather than an account, so
+-- requesting one doesn't tell whether the address has an account.
+ALTER TABLE gallery_transfers ADD COLUMN to_email TEXT;
+UPDATE gallery_transfers t
+SET to_email = u.email
+FROM users u
+WHERE t.to_user_id = u.id;
+ALTER TABLE gallery_transfers ALTER COLUMN to_email SET NOT NULL;
+ALTER TABLE gallery_transfers DROP COLUMN to_user_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- Transfers to addresses without an account are dropped.
+ALTER TABLE gallery_transfers ADD COLUMN to_user_id INT REFERENCES users (id) ON DELETE CASCADE;
+UPDATE gallery_transfers t
+SET to_user_id = u.id
+FROM users u
+WHERE t.to_email = u.email;
+DELETE FROM gallery_transfers
+WHERE to_user_id IS NULL;
+ALTER TABLE gallery_transfers ALTER COLUMN to_user_id SET NOT NULL;
+ALTER TABLE gallery_transfers DROP COLUMN to_email;
+-- +goose StatementEnd
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestFilename is the name of the file listing the contents of gallery
+// archives.
+const ManifestFilename = "manifest.csv"
+
+// WriteArchive streams a ZIP archive of images to dst. Images are written in
+// their original format, or scaled down to size when size is not nil. When wm
+// is not nil, they are written as JPEG with the watermark drawn over them,
+// so the originals never leave. The archive ends with a manifest listing every
+// file with its size and SHA-256.
+//
+// Nothing is buffered beyond a single read, so a failure part way leaves dst
+// with a truncated archive.
+func (service *GalleryService) WriteArchive(dst io.Writer, images []Image, size *ImageSize, wm *Watermark) error {
+	zw := zip.NewWriter(dst)
+	var manifest [][]string
+	names := make(map[string]bool)
+	for _, image := range images {
+		file := image
+		var err error
+		switch {
+		case size != nil && wm != nil:
+			file, err = service.WatermarkedResized(image, *size, *wm)
+		case size != nil:
+			file, err = service.Resized(image, *size)
+		case wm != nil:
+			file, err = service.Watermarked(image, *wm)
+		}
+		if err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+		name := archiveName(file.Filename, names)
+		n, hash, err := service.writeArchiveFile(zw, file, name)
+		if err != nil {
+			return fmt.Errorf("write archive: %w", err)
+		}
+		manifest = append(manifest, []string{name, image.Filename, strconv.FormatInt(n, 10), hash})
+	}
+
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     ManifestFilename,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("write archive manifest: %w", err)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"filename", "original_filename", "bytes", "sha256"})
+	cw.WriteAll(manifest)
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("write archive manifest: %w", err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("write archive: %w", err)
+	}
+	return nil
+}
+
+// writeArchiveFile copies one image into the archive, returning its size and
+// hex encoded SHA-256.
+func (service *GalleryService) writeArchiveFile(zw *zip.Writer, image Image, name string) (int64, string, error) {
+	src, obj, err := service.OpenImage(image)
+	if err != nil {
+		return 0, "", err
+	}
+	defer src.Close()
+	// Images are compressed already, deflating them again only costs CPU.
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: obj.ModTime,
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("adding %s: %w", name, err)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), src)
+	if err != nil {
+		return 0, "", fmt.Errorf("adding %s: %w", name, err)
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// archiveName returns filename, or a numbered variant of it if the name was
+// used already. Converted images can end up with the same name, like
+// "photo.png" and "photo.webp" both becoming "photo.jpg".
+func archiveName(filename string, used map[string]bool) string {
+	name := filename
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for i := 2; used[strings.ToLower(name)] || strings.EqualFold(name, ManifestFilename); i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
@@ -0,0 +1,362 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Unreferenced blobs are kept around for this long before they are
+	// garbage collected, so an image that is deleted and uploaded again right
+	// after doesn't need to be stored again.
+	DefaultBlobGracePeriod = 24 * time.Hour
+)
+
+// Image files are stored once per distinct content, under a key derived from
+// the SHA-256 of the contents. The blobs table counts how many images refer
+// to each blob, and blobs nobody refers to are removed by CollectGarbage.
+//
+// Every change to a blob row happens in a transaction that holds the row
+// lock while the blob file is written or deleted. This makes sure garbage
+// collection can never delete a file that a concurrent upload is relying on:
+// the upload either waits for the collection to finish and then stores the
+// file again, or it references the blob first and the collection skips it.
+
+// blobKey returns the storage key of a blob. Blobs are sharded into two
+// levels of directories by the first bytes of the hash, so no directory ends
+// up with more than a few hundred entries.
+func blobKey(hash string) string {
+	return "blobs/" + hash[0:2] + "/" + hash[2:4] + "/" + hash
+}
+
+// variantKey returns the storage key of a file derived from a blob, like the
+// JPEG fallback of a WebP. Variants are removed along with their blob.
+func variantKey(hash, ext string) string {
+	return "variants/" + hash[0:2] + "/" + hash[2:4] + "/" + hash + ext
+}
+
+// retainBlob adds a reference to the blob with the given hash, storing the
+// contents if the blob doesn't exist yet, or if its file was found
+// corrupted.
+func (service *GalleryService) retainBlob(tx *sql.Tx, hash string, size int64, contents io.Reader) error {
+	var inserted, corrupted bool
+	row := tx.QueryRow(`
+		INSERT INTO
+			blobs (hash, size, ref_count)
+		VALUES ($1, $2, 1) ON
+		CONFLICT (hash) DO
+		UPDATE
+		SET
+			ref_count = blobs.ref_count + 1, unreferenced_at = NULL
+		RETURNING (xmax = 0), EXISTS (
+			SELECT 1 FROM scrub_failures WHERE key = $3 AND resolved_at IS NULL
+		);
+	`, hash, size, blobKey(hash))
+	err := row.Scan(&inserted, &corrupted)
+	if err != nil {
+		return fmt.Errorf("retain blob: %w", err)
+	}
+	if !inserted && !corrupted {
+		return nil
+	}
+	err = service.storage().Put(blobKey(hash), contents)
+	if err != nil {
+		return fmt.Errorf("retain blob: %w", err)
+	}
+	if corrupted {
+		_, err = tx.Exec(`
+			UPDATE blobs
+			SET size = $2, verified_at = NULL
+			WHERE hash = $1;
+		`, hash, size)
+		if err != nil {
+			return fmt.Errorf("retain blob: %w", err)
+		}
+		err = resolveScrubFailures(tx, blobKey(hash))
+		if err != nil {
+			return fmt.Errorf("retain blob: %w", err)
+		}
+	}
+	return nil
+}
+
+// addBlobRef adds a reference to a blob that is known to exist.
+func (service *GalleryService) addBlobRef(tx *sql.Tx, hash string) error {
+	res, err := tx.Exec(`
+		UPDATE blobs
+		SET ref_count = ref_count + 1, unreferenced_at = NULL
+		WHERE hash = $1;
+	`, hash)
+	if err != nil {
+		return fmt.Errorf("add blob ref: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("add blob ref: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("add blob ref: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// releaseBlob removes count references from the blob with the given hash.
+func (service *GalleryService) releaseBlob(tx *sql.Tx, hash string, count int) error {
+	_, err := tx.Exec(`
+		UPDATE blobs
+		SET
+			ref_count = ref_count - $2,
+			unreferenced_at = CASE WHEN ref_count - $2 <= 0 THEN now() END
+		WHERE hash = $1;
+	`, hash, count)
+	if err != nil {
+		return fmt.Errorf("release blob: %w", err)
+	}
+	return nil
+}
+
+// CollectGarbage deletes blobs that have not been referenced by any image for
+// at least gracePeriod, along with their variants. It returns the number of
+// blobs deleted.
+func (service *GalleryService) CollectGarbage(gracePeriod time.Duration) (int, error) {
+	deleted := 0
+	for {
+		ok, err := service.collectOneBlob(gracePeriod)
+		if err != nil {
+			return deleted, fmt.Errorf("collect garbage: %w", err)
+		}
+		if !ok {
+			return deleted, nil
+		}
+		deleted++
+	}
+}
+
+// collectOneBlob deletes a single unreferenced blob. It reports false once
+// there is nothing left to collect.
+func (service *GalleryService) collectOneBlob(gracePeriod time.Duration) (bool, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var hash string
+	row := tx.QueryRow(`
+		SELECT hash
+		FROM blobs
+		WHERE ref_count <= 0 AND unreferenced_at < $1
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED;
+	`, time.Now().Add(-gracePeriod))
+	err = row.Scan(&hash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	// Files are deleted before the row so that a crash in between leaves a
+	// row to retry later instead of a file nobody knows about.
+	variants, err := service.storage().List(variantKey(hash, ""))
+	if err != nil {
+		return false, err
+	}
+	for _, obj := range variants {
+		err = service.storage().Delete(obj.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+	}
+	err = service.storage().Delete(blobKey(hash))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM variants
+		WHERE hash = $1;
+	`, hash)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM blobs
+		WHERE hash = $1;
+	`, hash)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ImportLegacyImages moves images stored in the old gallery-<id>/<filename>
+// layout into blob storage and removes the old files. Files of galleries that
+// no longer exist are left alone. Files that fail to import are logged and
+// left in place for the next run, so one unreadable file doesn't hold up the
+// others. It returns the number of images imported.
+func (service *GalleryService) ImportLegacyImages() (int, error) {
+	objects, err := service.storage().List("gallery-")
+	if err != nil {
+		return 0, fmt.Errorf("import legacy images: %w", err)
+	}
+
+	imported := 0
+	for _, obj := range objects {
+		dir, filename, ok := strings.Cut(obj.Key, "/")
+		if !ok || strings.Contains(filename, "/") || !hasExtension(filename, service.extensions()) {
+			continue
+		}
+		galleryID, err := strconv.Atoi(strings.TrimPrefix(dir, "gallery-"))
+		if err != nil {
+			continue
+		}
+		_, err = service.ByID(galleryID)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return imported, fmt.Errorf("import legacy images: %w", err)
+		}
+
+		err = service.importLegacyImage(galleryID, filename, obj)
+		if err != nil {
+			fmt.Printf("import legacy images: skipping %v: %v\n", obj.Key, err)
+			continue
+		}
+		imported++
+	}
+
+	// Old fallbacks are regenerated from the blobs when needed.
+	objects, err = service.storage().List("gallery-")
+	if err != nil {
+		return imported, fmt.Errorf("import legacy images: %w", err)
+	}
+	for _, obj := range objects {
+		if strings.Contains(obj.Key, "/.fallback/") {
+			err = service.storage().Delete(obj.Key)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return imported, fmt.Errorf("import legacy images: %w", err)
+			}
+		}
+	}
+	return imported, nil
+}
+
+func (service *GalleryService) importLegacyImage(galleryID int, filename string, obj StorageObject) error {
+	f, err := service.storage().Get(obj.Key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	contentHash, perceptualHash, err := hashImage(f)
+	if err != nil {
+		return err
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldHash string
+	row := tx.QueryRow(`
+		SELECT content_hash
+		FROM images
+		WHERE gallery_id = $1 AND filename = $2
+		FOR UPDATE;
+	`, galleryID, filename)
+	err = row.Scan(&oldHash)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// Rows recorded before blobs existed never held a reference. Rows
+	// imported by an earlier run whose delete of the old file failed do, and
+	// are only left to delete that file.
+	held := false
+	if exists {
+		held, err = blobFullyReferenced(tx, oldHash)
+		if err != nil {
+			return err
+		}
+	}
+	if held && oldHash == contentHash {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return service.storage().Delete(obj.Key)
+	}
+	if held {
+		err = service.releaseBlob(tx, oldHash, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = service.retainBlob(tx, contentHash, obj.Size, f)
+	if err != nil {
+		return err
+	}
+	id, err := newImageID()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO images (public_id, gallery_id, filename, content_hash, perceptual_hash)
+		VALUES ($1, $2, $3, $4, $5) ON
+		CONFLICT (gallery_id, filename) DO
+		UPDATE
+		SET
+			content_hash = $4, perceptual_hash = $5;
+	`, id, galleryID, filename, contentHash, int64(perceptualHash))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return service.storage().Delete(obj.Key)
+}
+
+// blobFullyReferenced reports whether the blob with the given hash counts a
+// reference for every image with that content, like Reconcile expects. An
+// image whose blob falls short was recorded before blobs existed and doesn't
+// hold a reference yet. The row of the blob is locked until the transaction
+// ends.
+func blobFullyReferenced(tx *sql.Tx, hash string) (bool, error) {
+	var refCount int
+	row := tx.QueryRow(`
+		SELECT ref_count
+		FROM blobs
+		WHERE hash = $1
+		FOR UPDATE;
+	`, hash)
+	err := row.Scan(&refCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("blob references: %w", err)
+	}
+	var images int
+	row = tx.QueryRow(`
+		SELECT count(*)
+		FROM images
+		WHERE content_hash = $1;
+	`, hash)
+	err = row.Scan(&images)
+	if err != nil {
+		return false, fmt.Errorf("blob references: %w", err)
+	}
+	return refCount >= images, nil
+}
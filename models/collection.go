@@ -0,0 +1,291 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrCollectionCycle = errors.New("models: a collection can't be inside itself")
+
+// Collection groups galleries, and other collections, under one title, like
+// all the galleries of an event.
+type Collection struct {
+	ID     int
+	UserID int
+	// ParentID is the collection this one is part of, or 0.
+	ParentID int
+	Title    string
+	// Visibility is either VisibilityPublic or VisibilityPrivate. Galleries
+	// in a collection keep their own visibility.
+	Visibility string
+	// CoverImageID is the ID of the image chosen to represent the
+	// collection, if any.
+	CoverImageID string
+}
+
+type CollectionService struct {
+	DB *sql.DB
+}
+
+func (service *CollectionService) Create(userID int, title string, parentID int) (*Collection, error) {
+	collection := Collection{
+		UserID:     userID,
+		ParentID:   parentID,
+		Title:      title,
+		Visibility: VisibilityPublic,
+	}
+	row := service.DB.QueryRow(`
+		INSERT INTO collections (user_id, parent_id, title, visibility)
+		VALUES ($1, nullif($2, 0), $3, $4) RETURNING id;
+	`, collection.UserID, collection.ParentID, collection.Title, collection.Visibility)
+	err := row.Scan(&collection.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+	return &collection, nil
+}
+
+func (service *CollectionService) ByID(id int) (*Collection, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, parent_id, title, visibility, cover_image_id
+		FROM collections
+		WHERE id = $1;
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("query collection by id: %w", err)
+	}
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collection by id: %w", err)
+	}
+	if len(collections) == 0 {
+		return nil, ErrNotFound
+	}
+	return &collections[0], nil
+}
+
+// ByUserID returns all the collections of a user, by title.
+func (service *CollectionService) ByUserID(userID int) ([]Collection, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, parent_id, title, visibility, cover_image_id
+		FROM collections
+		WHERE user_id = $1
+		ORDER BY title, id;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query collections by user: %w", err)
+	}
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collections by user: %w", err)
+	}
+	return collections, nil
+}
+
+// Children returns the collections directly inside a collection, by title.
+// If publicOnly is set, private collections are left out.
+func (service *CollectionService) Children(id int, publicOnly bool) ([]Collection, error) {
+	rows, err := service.DB.Query(`
+		SELECT id, user_id, parent_id, title, visibility, cover_image_id
+		FROM collections
+		WHERE parent_id = $1 AND (NOT $2 OR visibility = 'public')
+		ORDER BY title, id;
+	`, id, publicOnly)
+	if err != nil {
+		return nil, fmt.Errorf("query collection children: %w", err)
+	}
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collection children: %w", err)
+	}
+	return collections, nil
+}
+
+// Breadcrumbs returns the collections containing a collection, from the
+// outermost one down to the collection itself.
+func (service *CollectionService) Breadcrumbs(id int) ([]Collection, error) {
+	rows, err := service.DB.Query(`
+		WITH RECURSIVE ancestors AS (
+			SELECT id, user_id, parent_id, title, visibility, cover_image_id, 0 AS depth
+			FROM collections
+			WHERE id = $1
+			UNION ALL
+			SELECT c.id, c.user_id, c.parent_id, c.title, c.visibility, c.cover_image_id, a.depth + 1
+			FROM collections c
+			JOIN ancestors a ON c.id = a.parent_id
+		)
+		SELECT id, user_id, parent_id, title, visibility, cover_image_id
+		FROM ancestors
+		ORDER BY depth DESC;
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("query collection breadcrumbs: %w", err)
+	}
+	collections, err := scanCollections(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query collection breadcrumbs: %w", err)
+	}
+	return collections, nil
+}
+
+// Update saves the title, visibility, parent and cover of a collection.
+// Moving a collection into itself or one of its sub-collections fails with
+// ErrCollectionCycle.
+func (service *CollectionService) Update(collection *Collection) error {
+	if collection.Visibility != VisibilityPublic && collection.Visibility != VisibilityPrivate {
+		return fmt.Errorf("update collection: invalid visibility %q", collection.Visibility)
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+	defer tx.Rollback()
+
+	if collection.ParentID != 0 {
+		// Lock the collections of the user so two concurrent moves can't
+		// create a cycle together.
+		_, err = tx.Exec(`
+			SELECT id FROM collections WHERE user_id = $1 FOR UPDATE;
+		`, collection.UserID)
+		if err != nil {
+			return fmt.Errorf("update collection: %w", err)
+		}
+		var cycle bool
+		row := tx.QueryRow(`
+			WITH RECURSIVE ancestors AS (
+				SELECT id, parent_id FROM collections WHERE id = $1
+				UNION ALL
+				SELECT c.id, c.parent_id
+				FROM collections c
+				JOIN ancestors a ON c.id = a.parent_id
+			)
+			SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2);
+		`, collection.ParentID, collection.ID)
+		err = row.Scan(&cycle)
+		if err != nil {
+			return fmt.Errorf("update collection: %w", err)
+		}
+		if cycle {
+			return fmt.Errorf("update collection: %w", ErrCollectionCycle)
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE collections
+		SET parent_id = nullif($2, 0), title = $3, visibility = $4, cover_image_id = nullif($5, '')
+		WHERE id = $1;
+	`, collection.ID, collection.ParentID, collection.Title, collection.Visibility, collection.CoverImageID)
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a collection and its sub-collections. The galleries in them
+// are kept, outside of any collection.
+func (service *CollectionService) Delete(id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM collections
+		WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	return nil
+}
+
+// Cover returns the image that represents a collection: the chosen cover if
+// there is one, or else the first image of the first gallery found in the
+// collection and its sub-collections. If publicOnly is set, images in private
+// galleries or collections are not considered. ErrNotFound is returned when
+// there is no image to show.
+func (service *CollectionService) Cover(collection Collection, publicOnly bool) (Image, error) {
+	var image Image
+	row := service.DB.QueryRow(`
+		WITH RECURSIVE tree AS (
+			SELECT id FROM collections WHERE id = $1
+			UNION ALL
+			SELECT c.id
+			FROM collections c
+			JOIN tree t ON c.parent_id = t.id
+			WHERE NOT $3 OR c.visibility = 'public'
+		)
+		SELECT i.public_id, i.gallery_id, i.filename, i.content_hash
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		WHERE (i.public_id = $2 AND g.user_id = $4 OR g.collection_id IN (SELECT id FROM tree))
+			AND (NOT $3 OR g.visibility = 'public')
+			AND i.deleted_at IS NULL AND g.deleted_at IS NULL
+		ORDER BY i.public_id = $2 DESC, g.title, g.id, i.filename
+		LIMIT 1;
+	`, collection.ID, collection.CoverImageID, publicOnly, collection.UserID)
+	err := row.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.ContentHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("querying for collection cover: %w", err)
+	}
+	image.Key = blobKey(image.ContentHash)
+	return image, nil
+}
+
+// CoverCandidates returns the images that can be chosen as the cover of a
+// collection: those of the galleries directly in it.
+func (service *CollectionService) CoverCandidates(id int) ([]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT i.public_id, i.gallery_id, i.filename, i.content_hash
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		WHERE g.collection_id = $1 AND i.deleted_at IS NULL AND g.deleted_at IS NULL
+		ORDER BY g.title, g.id, i.filename;
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("query collection cover candidates: %w", err)
+	}
+	defer rows.Close()
+
+	var images []Image
+	for rows.Next() {
+		var image Image
+		err := rows.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.ContentHash)
+		if err != nil {
+			return nil, fmt.Errorf("query collection cover candidates: %w", err)
+		}
+		image.Key = blobKey(image.ContentHash)
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query collection cover candidates: %w", err)
+	}
+	return images, nil
+}
+
+// scanCollections reads and closes rows of id, user_id, parent_id, title,
+// visibility and cover_image_id.
+func scanCollections(rows *sql.Rows) ([]Collection, error) {
+	defer rows.Close()
+	var collections []Collection
+	for rows.Next() {
+		var collection Collection
+		var parentID sql.NullInt64
+		var coverImageID sql.NullString
+		err := rows.Scan(&collection.ID, &collection.UserID, &parentID, &collection.Title,
+			&collection.Visibility, &coverImageID)
+		if err != nil {
+			return nil, err
+		}
+		collection.ParentID = int(parentID.Int64)
+		collection.CoverImageID = coverImageID.String
+		collections = append(collections, collection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
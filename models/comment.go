@@ -0,0 +1,207 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// Comments are shown to everyone who can view the gallery.
+	CommentVisible = "visible"
+	// Pending comments wait for the owner of the gallery to approve them.
+	CommentPending = "pending"
+	// Hidden comments are only shown to the owner of the gallery.
+	CommentHidden = "hidden"
+
+	MaxCommentLength    = 5000
+	MaxAuthorNameLength = 100
+)
+
+var ErrCommentEmpty = errors.New("models: comment is empty")
+
+type Comment struct {
+	ID        int
+	GalleryID int
+	// ImageID is the public ID of the image the comment is about.
+	ImageID string
+	// ParentID is the comment this one replies to, or 0.
+	ParentID int
+	// UserID is set when the author was signed in, and ShareLinkID when
+	// they were a guest using a share link.
+	UserID      int
+	ShareLinkID int
+	AuthorName  string
+	Body        string
+	Status      string
+	CreatedAt   time.Time
+
+	// Replies are set by ForImage.
+	Replies []*Comment
+}
+
+type CommentService struct {
+	DB *sql.DB
+}
+
+// Create adds a comment to an image. Replies must be to a comment on the same
+// image. ErrNotFound is returned if the image or parent doesn't exist.
+func (service *CommentService) Create(comment *Comment) error {
+	comment.Body = truncateRunes(strings.TrimSpace(comment.Body), MaxCommentLength)
+	// Names end up in email subjects, so they are kept to a single line.
+	comment.AuthorName = truncateRunes(strings.Join(strings.Fields(comment.AuthorName), " "), MaxAuthorNameLength)
+	if comment.Body == "" {
+		return fmt.Errorf("create comment: %w", ErrCommentEmpty)
+	}
+	if comment.Status == "" {
+		comment.Status = CommentVisible
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO comments (image_id, parent_id, user_id, share_link_id, author_name, body, status)
+		SELECT i.id, nullif($3, 0), nullif($4, 0), nullif($5, 0), $6, $7, $8
+		FROM images i
+		WHERE i.gallery_id = $1 AND i.public_id = $2 AND i.deleted_at IS NULL
+			AND ($3 = 0 OR EXISTS (
+				SELECT 1 FROM comments p WHERE p.id = $3 AND p.image_id = i.id
+			))
+		RETURNING id, created_at;
+	`, comment.GalleryID, comment.ImageID, comment.ParentID, comment.UserID, comment.ShareLinkID,
+		comment.AuthorName, comment.Body, comment.Status)
+	err := row.Scan(&comment.ID, &comment.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("create comment: %w", err)
+	}
+	return nil
+}
+
+// ForImage returns the comments on an image as threads, oldest first. Unless
+// all is set, only visible comments are returned, along with the replies to
+// them that are visible.
+func (service *CommentService) ForImage(galleryID int, imageID string, all bool) ([]*Comment, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+commentColumns+`
+		FROM comments c
+		JOIN images i ON i.id = c.image_id
+		WHERE i.gallery_id = $1 AND i.public_id = $2 AND ($3 OR c.status = 'visible')
+		ORDER BY c.created_at, c.id;
+	`, galleryID, imageID, all)
+	if err != nil {
+		return nil, fmt.Errorf("query comments for image: %w", err)
+	}
+	comments, err := scanComments(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query comments for image: %w", err)
+	}
+
+	// Parents always come before their replies, so each reply can be added
+	// as it is seen. Replies to comments that were left out are dropped.
+	byID := make(map[int]*Comment)
+	var threads []*Comment
+	for _, comment := range comments {
+		byID[comment.ID] = comment
+		if comment.ParentID == 0 {
+			threads = append(threads, comment)
+			continue
+		}
+		if parent, ok := byID[comment.ParentID]; ok {
+			parent.Replies = append(parent.Replies, comment)
+		}
+	}
+	return threads, nil
+}
+
+// Pending returns the comments on a gallery waiting for approval, oldest
+// first.
+func (service *CommentService) Pending(galleryID int) ([]*Comment, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+commentColumns+`
+		FROM comments c
+		JOIN images i ON i.id = c.image_id
+		WHERE i.gallery_id = $1 AND i.deleted_at IS NULL AND c.status = 'pending'
+		ORDER BY c.created_at, c.id;
+	`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query pending comments: %w", err)
+	}
+	comments, err := scanComments(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query pending comments: %w", err)
+	}
+	return comments, nil
+}
+
+// SetStatus approves, hides or shows again a comment on a gallery.
+func (service *CommentService) SetStatus(galleryID, id int, status string) error {
+	if status != CommentVisible && status != CommentPending && status != CommentHidden {
+		return fmt.Errorf("set comment status: invalid status %q", status)
+	}
+	result, err := service.DB.Exec(`
+		UPDATE comments c
+		SET status = $3
+		FROM images i
+		WHERE i.id = c.image_id AND i.gallery_id = $1 AND c.id = $2;
+	`, galleryID, id, status)
+	if err != nil {
+		return fmt.Errorf("set comment status: %w", err)
+	}
+	return checkRowsAffected(result, "set comment status")
+}
+
+// Delete removes a comment on a gallery, along with the replies to it.
+func (service *CommentService) Delete(galleryID, id int) error {
+	result, err := service.DB.Exec(`
+		DELETE FROM comments c
+		USING images i
+		WHERE i.id = c.image_id AND i.gallery_id = $1 AND c.id = $2;
+	`, galleryID, id)
+	if err != nil {
+		return fmt.Errorf("delete comment: %w", err)
+	}
+	return checkRowsAffected(result, "delete comment")
+}
+
+// commentColumns are the columns read by scanComments, for comments c joined
+// with their images i.
+const commentColumns = `c.id, i.gallery_id, i.public_id, c.parent_id, c.user_id, c.share_link_id,
+	c.author_name, c.body, c.status, c.created_at`
+
+// scanComments reads and closes rows of commentColumns.
+func scanComments(rows *sql.Rows) ([]*Comment, error) {
+	defer rows.Close()
+	var comments []*Comment
+	for rows.Next() {
+		var comment Comment
+		var parentID, userID, shareLinkID sql.NullInt64
+		err := rows.Scan(&comment.ID, &comment.GalleryID, &comment.ImageID, &parentID, &userID, &shareLinkID,
+			&comment.AuthorName, &comment.Body, &comment.Status, &comment.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		comment.ParentID = int(parentID.Int64)
+		comment.UserID = int(userID.Int64)
+		comment.ShareLinkID = int(shareLinkID.Int64)
+		comments = append(comments, &comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// checkRowsAffected returns ErrNotFound if a statement changed no rows.
+func checkRowsAffected(result sql.Result, op string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
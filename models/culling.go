@@ -0,0 +1,225 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	MaxRating = 5
+
+	FlagPick   = "pick"
+	FlagReject = "reject"
+	// FlagNone is used in filters to match images without a flag.
+	FlagNone = "none"
+)
+
+// ColorLabels are the labels images can have, in the order Lightroom uses.
+var ColorLabels = []string{"red", "yellow", "green", "blue", "purple"}
+
+var ErrInvalidCulling = errors.New("models: invalid rating, flag or color label")
+
+// ImageFilter selects images by their culling attributes. Zero values match
+// every image.
+type ImageFilter struct {
+	MinRating int
+	// Flag is FlagPick, FlagReject, FlagNone or empty.
+	Flag       string
+	ColorLabel string
+}
+
+// Match reports whether an image passes the filter.
+func (filter ImageFilter) Match(image Image) bool {
+	if image.Rating < filter.MinRating {
+		return false
+	}
+	switch filter.Flag {
+	case "":
+	case FlagNone:
+		if image.Flag != "" {
+			return false
+		}
+	default:
+		if image.Flag != filter.Flag {
+			return false
+		}
+	}
+	if filter.ColorLabel != "" && image.ColorLabel != filter.ColorLabel {
+		return false
+	}
+	return true
+}
+
+// FilterImages returns the images that pass filter, in the same order.
+func FilterImages(images []Image, filter ImageFilter) []Image {
+	var filtered []Image
+	for _, image := range images {
+		if filter.Match(image) {
+			filtered = append(filtered, image)
+		}
+	}
+	return filtered
+}
+
+// Orders images can be sorted in by SortImages.
+const (
+	SortByFilename = "filename"
+	SortByRating   = "rating"
+	SortByFlag     = "flag"
+	SortByColor    = "color"
+)
+
+// SortImages sorts images in place. Ratings are sorted best first, flags
+// picks first and colors in the order of ColorLabels, all with unlabelled
+// images last. Ties, and unknown orders, sort by filename.
+func SortImages(images []Image, order string) {
+	key := func(image Image) int { return 0 }
+	switch order {
+	case SortByRating:
+		key = func(image Image) int { return MaxRating - image.Rating }
+	case SortByFlag:
+		key = func(image Image) int {
+			switch image.Flag {
+			case FlagPick:
+				return 0
+			case FlagReject:
+				return 2
+			}
+			return 1
+		}
+	case SortByColor:
+		key = func(image Image) int {
+			for i, label := range ColorLabels {
+				if image.ColorLabel == label {
+					return i
+				}
+			}
+			return len(ColorLabels)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		ki, kj := key(images[i]), key(images[j])
+		if ki != kj {
+			return ki < kj
+		}
+		return images[i].Filename < images[j].Filename
+	})
+}
+
+// UpdateCulling saves the rating, flag and color label of an image.
+func (service *GalleryService) UpdateCulling(image Image) error {
+	if !validCulling(image) {
+		return fmt.Errorf("update culling: %w", ErrInvalidCulling)
+	}
+	result, err := service.DB.Exec(`
+		UPDATE images
+		SET rating = $3, flag = $4, color_label = $5
+		WHERE gallery_id = $1 AND public_id = $2 AND deleted_at IS NULL;
+	`, image.GalleryID, image.ID, image.Rating, image.Flag, image.ColorLabel)
+	if err != nil {
+		return fmt.Errorf("update culling: %w", err)
+	}
+	return checkRowsAffected(result, "update culling")
+}
+
+func validCulling(image Image) bool {
+	if image.Rating < 0 || image.Rating > MaxRating {
+		return false
+	}
+	if image.Flag != "" && image.Flag != FlagPick && image.Flag != FlagReject {
+		return false
+	}
+	if image.ColorLabel == "" {
+		return true
+	}
+	for _, label := range ColorLabels {
+		if image.ColorLabel == label {
+			return true
+		}
+	}
+	return false
+}
+
+// MoveImages moves several images of a gallery to another gallery of the
+// same user. Images are renamed if their filename is already used in the
+// other gallery. Either all of them are moved or, on error, none.
+func (service *GalleryService) MoveImages(galleryID int, ids []string, toGalleryID int) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("move images: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = lockGallery(tx, toGalleryID)
+	if err != nil {
+		return fmt.Errorf("move images: %w", err)
+	}
+	rows, err := tx.Query(`
+		SELECT i.public_id, i.filename, COALESCE(b.size, 0)
+		FROM images i
+		LEFT JOIN blobs b ON b.hash = i.content_hash
+		WHERE i.gallery_id = $1 AND i.public_id = ANY($2) AND i.deleted_at IS NULL
+		ORDER BY i.filename;
+	`, galleryID, ids)
+	if err != nil {
+		return fmt.Errorf("move images: %w", err)
+	}
+	type move struct {
+		id       string
+		filename string
+		size     int64
+	}
+	var moves []move
+	for rows.Next() {
+		var m move
+		err := rows.Scan(&m.id, &m.filename, &m.size)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("move images: %w", err)
+		}
+		moves = append(moves, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("move images: %w", err)
+	}
+
+	var moved []string
+	for _, m := range moves {
+		// The images stay with the same user, so only the quota of the
+		// gallery they move to matters.
+		err = service.checkGalleryQuota(tx, toGalleryID, m.size, Usage{})
+		if err != nil {
+			return fmt.Errorf("move images: %w", err)
+		}
+		filename, err := uniqueFilename(tx, toGalleryID, m.filename)
+		if err != nil {
+			return fmt.Errorf("move images: %w", err)
+		}
+		_, err = tx.Exec(`
+			UPDATE images
+			SET gallery_id = $2, filename = $3
+			WHERE public_id = $1;
+		`, m.id, toGalleryID, filename)
+		if err != nil {
+			return fmt.Errorf("move images: %w", err)
+		}
+		moved = append(moved, m.id)
+	}
+	// Client selections belong to the share links of the gallery the images
+	// were in.
+	_, err = tx.Exec(`
+		DELETE FROM proof_marks
+		WHERE image_id IN (SELECT id FROM images WHERE gallery_id = $1 AND public_id = ANY($2));
+	`, toGalleryID, moved)
+	if err != nil {
+		return fmt.Errorf("move images: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("move images: %w", err)
+	}
+	return nil
+}
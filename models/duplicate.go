@@ -0,0 +1,120 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// CopyImages copies several images of a gallery to another gallery, like
+// CopyImage. Either all of them are copied or, on error, none.
+func (service *GalleryService) CopyImages(galleryID int, ids []string, toGalleryID int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("copy images: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = lockGallery(tx, toGalleryID)
+	if err != nil {
+		return fmt.Errorf("copy images: %w", err)
+	}
+	err = service.copyImages(tx, galleryID, ids, toGalleryID)
+	if err != nil {
+		return fmt.Errorf("copy images: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("copy images: %w", err)
+	}
+	return nil
+}
+
+// Duplicate creates a new gallery with the given title and the settings and
+// images of an existing one, to use it as a template. Share links, comments
+// and client selections stay with the original. Either the whole gallery is
+// copied or, on error, nothing.
+func (service *GalleryService) Duplicate(id int, title string) (*Gallery, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+	defer tx.Rollback()
+
+	var newID int
+	row := tx.QueryRow(`
+		INSERT INTO galleries (title, user_id, visibility, allow_downloads, tags, collection_id,
+			comments_require_approval, watermark)
+		SELECT $2, user_id, visibility, allow_downloads, tags, collection_id, comments_require_approval,
+			watermark
+		FROM galleries
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING id;
+	`, id, title)
+	err = row.Scan(&newID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+	// Nobody else can see the new gallery before the transaction commits, so
+	// it doesn't need to be locked.
+	err = service.copyImages(tx, id, nil, newID)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("duplicate gallery: %w", err)
+	}
+	return service.ByID(newID)
+}
+
+// copyImages copies the images of a gallery with the given IDs, or all of
+// them if ids is nil, to another gallery.
+func (service *GalleryService) copyImages(tx *sql.Tx, galleryID int, ids []string, toGalleryID int) error {
+	rows, err := tx.Query(`
+		SELECT i.public_id, i.filename, i.content_hash, COALESCE(b.size, 0)
+		FROM images i
+		LEFT JOIN blobs b ON b.hash = i.content_hash
+		WHERE i.gallery_id = $1 AND ($2::text[] IS NULL OR i.public_id = ANY($2)) AND i.deleted_at IS NULL
+		ORDER BY i.filename;
+	`, galleryID, ids)
+	if err != nil {
+		return err
+	}
+	type imageCopy struct {
+		image Image
+		size  int64
+	}
+	var copies []imageCopy
+	for rows.Next() {
+		var c imageCopy
+		err := rows.Scan(&c.image.ID, &c.image.Filename, &c.image.ContentHash, &c.size)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		c.image.GalleryID = galleryID
+		c.image.Key = blobKey(c.image.ContentHash)
+		copies = append(copies, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range copies {
+		_, err = service.copyImage(tx, c.image, c.size, toGalleryID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
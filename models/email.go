@@ -2,6 +2,8 @@ package models
 
 import (
 	"fmt"
+	"html"
+	"strings"
 
 	"github.com/go-mail/mail/v2"
 )
@@ -75,6 +77,70 @@ func (es *EmailService) ForgotPassword(to, resetURL string) error {
 	return nil
 }
 
+// NewComment tells the owner of a gallery that someone commented on one of
+// its images.
+func (es *EmailService) NewComment(to, author, filename, body, commentURL string) error {
+	email := Email{
+		To:      to,
+		Subject: oneLine(fmt.Sprintf("%s commented on %s", author, filename)),
+		Plaintext: fmt.Sprintf("%s commented on %s:\n\n%s\n\nView and reply: %s",
+			author, filename, body, commentURL),
+		HTML: fmt.Sprintf(`<p>%s commented on %s:</p><blockquote style="white-space: pre-line">%s</blockquote><p><a href="%s">View and reply</a></p>`,
+			html.EscapeString(author), html.EscapeString(filename), html.EscapeString(body), html.EscapeString(commentURL)),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("new comment email: %w", err)
+	}
+	return nil
+}
+
+// SelectionSubmitted tells the owner of a gallery that a client submitted
+// their favorites, listing the chosen filenames.
+func (es *EmailService) SelectionSubmitted(to, galleryTitle, client string, filenames []string, selectionURL string) error {
+	var escaped []string
+	for _, filename := range filenames {
+		escaped = append(escaped, "<li>"+html.EscapeString(filename)+"</li>")
+	}
+	email := Email{
+		To:      to,
+		Subject: oneLine(fmt.Sprintf("%s submitted %d favorites from %s", client, len(filenames), galleryTitle)),
+		Plaintext: fmt.Sprintf("%s submitted their selection from %s:\n\n%s\n\nExport it as CSV or for Lightroom: %s",
+			client, galleryTitle, strings.Join(filenames, "\n"), selectionURL),
+		HTML: fmt.Sprintf(`<p>%s submitted their selection from %s:</p><ul>%s</ul><p><a href="%s">Export it as CSV or for Lightroom</a></p>`,
+			html.EscapeString(client), html.EscapeString(galleryTitle), strings.Join(escaped, ""), html.EscapeString(selectionURL)),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("selection submitted email: %w", err)
+	}
+	return nil
+}
+
+// GalleryTransfer asks someone to accept a gallery another user wants to hand
+// over to them. The address may not have an account yet.
+func (es *EmailService) GalleryTransfer(to, from, galleryTitle, acceptURL string) error {
+	email := Email{
+		To:      to,
+		Subject: oneLine(fmt.Sprintf("%s wants to transfer %s to you", from, galleryTitle)),
+		Plaintext: fmt.Sprintf("%s wants to transfer the gallery %s to you, with its images, share links and comments.\n\nReview and accept it: %s\n\nIf you don't have an account yet, sign up with %s first.",
+			from, galleryTitle, acceptURL, to),
+		HTML: fmt.Sprintf(`<p>%s wants to transfer the gallery %s to you, with its images, share links and comments.</p><p><a href="%s">Review and accept it</a></p><p>If you don't have an account yet, sign up with %s first.</p>`,
+			html.EscapeString(from), html.EscapeString(galleryTitle), html.EscapeString(acceptURL), html.EscapeString(to)),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("gallery transfer email: %w", err)
+	}
+	return nil
+}
+
+// oneLine collapses whitespace, including line breaks, so text can be used in
+// a header.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
 func (es *EmailService) setFrom(msg *mail.Message, email Email) {
 	var from string
 	switch {
@@ -6,11 +6,14 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 var (
-	ErrNotFound   = errors.New("models: resource could not be found")
-	ErrEmailTaken = errors.New("models: email address is already in use")
+	ErrNotFound      = errors.New("models: resource could not be found")
+	ErrEmailTaken    = errors.New("models: email address is already in use")
+	ErrImageTooLarge = errors.New("models: image is too large")
 )
 
 type FileError struct {
@@ -21,6 +24,18 @@ func (fe FileError) Error() string {
 	return fmt.Sprintf("invalid file: %v", fe.Issue)
 }
 
+// DuplicateImageError is returned when an uploaded image has exactly the same
+// contents as an image already in the gallery.
+type DuplicateImageError struct {
+	Filename string
+	// Existing is the filename of the image already in the gallery.
+	Existing string
+}
+
+func (de DuplicateImageError) Error() string {
+	return fmt.Sprintf("duplicate image: %v has the same contents as %v", de.Filename, de.Existing)
+}
+
 func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
 	testBytes := make([]byte, 512)
 	_, err := r.Read(testBytes)
@@ -32,6 +47,12 @@ func checkContentType(r io.ReadSeeker, allowedTypes []string) error {
 		return fmt.Errorf("checking content type: %w", err)
 	}
 
+	return checkSniffedContentType(testBytes, allowedTypes)
+}
+
+// checkSniffedContentType checks the content type of a file given its first
+// 512 bytes.
+func checkSniffedContentType(testBytes []byte, allowedTypes []string) error {
 	contentType := http.DetectContentType(testBytes)
 	for _, t := range allowedTypes {
 		if contentType == t {
@@ -53,3 +74,11 @@ func checkExtension(filename string, allowedExtensions []string) error {
 
 	return nil
 }
+
+// isInvalidTextRepresentation reports whether a query failed because a text
+// parameter couldn't be cast to the type it was compared with, like a
+// malformed timestamp.
+func isInvalidTextRepresentation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "22P02" || pgErr.Code == "22007" || pgErr.Code == "22008")
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"path/filepath"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// JPEG quality used when generating fallback images.
+	FallbackJPEGQuality = 85
+)
+
+// needsFallback reports whether a file is stored in a format that some
+// browsers cannot display, and should therefore be offered as JPEG too.
+func needsFallback(filename string) bool {
+	return strings.ToLower(filepath.Ext(filename)) == ".webp"
+}
+
+// encodeJPEGFallback decodes the image read from src and writes it to dst as
+// a JPEG.
+func encodeJPEGFallback(dst io.Writer, src io.Reader) error {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+	err = jpeg.Encode(dst, flatten(img), &jpeg.Options{Quality: FallbackJPEGQuality})
+	if err != nil {
+		return fmt.Errorf("encoding jpeg: %w", err)
+	}
+	return nil
+}
+
+// flatten draws an image onto a white background. JPEG has no alpha channel,
+// and without this transparent areas of a WebP would turn black.
+func flatten(img image.Image) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
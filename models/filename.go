@@ -0,0 +1,105 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	// Longest filename kept, in bytes. Most filesystems allow 255.
+	maxFilenameLength = 200
+)
+
+// sanitizeFilename turns a client supplied filename into one that is safe to
+// store and to offer in downloads. Directories are dropped, the name is
+// normalized to Unicode NFC (macOS sends decomposed names), control and
+// reserved characters are replaced, and overly long names are shortened
+// while keeping their extension.
+func sanitizeFilename(filename string) string {
+	filename = norm.NFC.String(filename)
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+
+	filename = strings.Map(func(r rune) rune {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, filename)
+	// Windows doesn't allow names ending in dots or spaces, and names starting
+	// with a dot are hidden.
+	filename = strings.Trim(filename, ". ")
+
+	ext := filepath.Ext(filename)
+	name := strings.TrimSpace(strings.TrimSuffix(filename, ext))
+	if len(ext) > 16 {
+		ext = ""
+	}
+	if name == "" {
+		name = "image"
+	}
+	for len(name)+len(ext) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name + ext
+}
+
+// uniqueFilename returns filename if no image in the gallery uses it yet, or
+// otherwise the first free name of the form "name (2).ext". Callers need to
+// hold a lock on the gallery so the name stays free until they use it.
+func uniqueFilename(tx *sql.Tx, galleryID int, filename string) (string, error) {
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	candidate := filename
+	for i := 2; ; i++ {
+		var exists bool
+		row := tx.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1
+				FROM images
+				WHERE gallery_id = $1 AND filename = $2
+			);
+		`, galleryID, candidate)
+		err := row.Scan(&exists)
+		if err != nil {
+			return "", fmt.Errorf("unique filename: %w", err)
+		}
+		if !exists {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s (%d)%s", name, i, ext)
+	}
+}
+
+// lockGallery locks the row of a gallery until the transaction ends.
+func lockGallery(tx *sql.Tx, galleryID int) error {
+	var id int
+	row := tx.QueryRow(`
+		SELECT id
+		FROM galleries
+		WHERE id = $1
+		FOR UPDATE;
+	`, galleryID)
+	err := row.Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("lock gallery: %w", err)
+	}
+	return nil
+}
@@ -1,46 +1,149 @@
 package models
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"archazid.io/lenslocked/rand"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// Public galleries can be viewed by anyone.
+	VisibilityPublic = "public"
+	// Private galleries can only be viewed by their owner and through share
+	// links.
+	VisibilityPrivate = "private"
 )
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// Visibility is either VisibilityPublic or VisibilityPrivate.
+	Visibility string
+	// AllowDownloads lets visitors of a public gallery download its images.
+	// Share links have their own setting.
+	AllowDownloads bool
+	// Tags are normalized by ParseTags.
+	Tags []string
+	// CollectionID is the collection the gallery is part of, or 0.
+	CollectionID int
+	// CommentsRequireApproval hides comments by others until the owner
+	// approves them.
+	CommentsRequireApproval bool
+	// Watermark marks the images shown to visitors with the owner's
+	// watermark. The owner always sees the originals.
+	Watermark bool
+	CreatedAt time.Time
+	// UpdatedAt changes with the settings of the gallery, and when images
+	// are added, removed or edited.
+	UpdatedAt time.Time
 }
 
 type GalleryService struct {
 	DB *sql.DB
 
-	// The directory where to store and locate images
+	// Storage is where image files are kept. If nil, images are stored on
+	// local disk under ImageDir.
+	Storage Storage
+	// The directory where to store and locate images when Storage is nil
 	ImageDir string
+
+	// Limits on the images stored by each user and in each gallery.
+	UserQuota    Quota
+	GalleryQuota Quota
+
+	// RenderCache keeps the images made by Transformed.
+	RenderCache *RenderCache
+	// TransformKey signs transforms that aren't presets. Without it, only
+	// presets can be requested.
+	TransformKey []byte
 }
 
 type Image struct {
+	// ID identifies the image in URLs. It is random, so the images of a
+	// gallery can't be guessed.
+	ID        string
 	GalleryID int
-	Path      string
-	Filename  string
+	// Key locates the image file in the gallery storage.
+	Key string
+	// Filename is the sanitized name of the file as it was uploaded. It is
+	// unique within the gallery.
+	Filename string
+	// ContentHash is the hex encoded SHA-256 of the image file.
+	ContentHash string
+	Caption     string
+	// Tags are normalized by ParseTags.
+	Tags []string
+
+	// Rating, Flag and ColorLabel are set by the owner while culling.
+	// Rating goes from 0, unrated, to MaxRating.
+	Rating int
+	// Flag is FlagPick, FlagReject or empty.
+	Flag string
+	// ColorLabel is one of ColorLabels or empty.
+	ColorLabel string
+}
+
+// ContentType returns the media type of the image based on its extension.
+func (image Image) ContentType() string {
+	switch strings.ToLower(filepath.Ext(image.Filename)) {
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".webp":
+		return "image/webp"
+	}
+	return "application/octet-stream"
+}
+
+// Version identifies the contents of the image in URLs, so URLs change when
+// the image is replaced. It is empty for images without a content hash.
+func (image Image) Version() string {
+	if len(image.ContentHash) < 16 {
+		return ""
+	}
+	return image.ContentHash[:16]
+}
+
+// ETag returns a strong HTTP entity tag for the file of the image. Blobs and
+// their variants are named after the content hash, along with what the
+// variant is, so the tag changes whenever the served bytes do.
+func (image Image) ETag() string {
+	if image.ContentHash == "" {
+		return ""
+	}
+	return `"` + path.Base(image.Key) + `"`
 }
 
 func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
 	gallery := Gallery{
-		Title:  title,
-		UserID: userID,
+		Title:          title,
+		UserID:         userID,
+		Visibility:     VisibilityPublic,
+		AllowDownloads: true,
+		Tags:           []string{},
 	}
 
 	row := service.DB.QueryRow(`
-		INSERT INTO galleries (title, user_id)
-		VALUES ($1, $2) RETURNING id;
-	`, gallery.Title, gallery.UserID)
-	err := row.Scan(&gallery.ID)
+		INSERT INTO galleries (title, user_id, visibility, allow_downloads)
+		VALUES ($1, $2, $3, $4) RETURNING id, created_at, updated_at;
+	`, gallery.Title, gallery.UserID, gallery.Visibility, gallery.AllowDownloads)
+	err := row.Scan(&gallery.ID, &gallery.CreatedAt, &gallery.UpdatedAt)
 	if err != nil {
 		return nil, fmt.Errorf("create gallery: %w", err)
 	}
@@ -48,176 +151,707 @@ func (service *GalleryService) Create(title string, userID int) (*Gallery, error
 }
 
 func (service *GalleryService) ByID(id int) (*Gallery, error) {
-	gallery := Gallery{
-		ID: id,
-	}
-
-	row := service.DB.QueryRow(`
-		SELECT title, user_id
+	rows, err := service.DB.Query(`
+		SELECT `+galleryColumns+`
 		FROM galleries
-		WHERE id = $1;
-	`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+		WHERE id = $1 AND deleted_at IS NULL;
+	`, id)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNotFound
-		}
 		return nil, fmt.Errorf("query gallery by id: %w", err)
 	}
-	return &gallery, nil
+	galleries, err := scanGalleries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery by id: %w", err)
+	}
+	if len(galleries) == 0 {
+		return nil, ErrNotFound
+	}
+	return &galleries[0], nil
 }
 
 func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 	rows, err := service.DB.Query(`
-		SELECT id, title
+		SELECT `+galleryColumns+`
 		FROM galleries
-		WHERE user_id = $1;
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY lower(coalesce(title, '')), id;
 	`, userID)
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user: %w", err)
 	}
+	galleries, err := scanGalleries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query galleries by user: %w", err)
+	}
+	return galleries, nil
+}
 
+// ByCollectionID returns the galleries directly in a collection, by title.
+// If publicOnly is set, private galleries are left out.
+func (service *GalleryService) ByCollectionID(collectionID int, publicOnly bool) ([]Gallery, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+galleryColumns+`
+		FROM galleries
+		WHERE collection_id = $1 AND (NOT $2 OR visibility = 'public') AND deleted_at IS NULL
+		ORDER BY title, id;
+	`, collectionID, publicOnly)
+	if err != nil {
+		return nil, fmt.Errorf("query galleries by collection: %w", err)
+	}
+	galleries, err := scanGalleries(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query galleries by collection: %w", err)
+	}
+	return galleries, nil
+}
+
+// galleryColumns are the columns of the galleries table read by
+// scanGalleries, in order.
+const galleryColumns = `id, user_id, coalesce(title, ''), visibility, allow_downloads, tags, collection_id,
+	comments_require_approval, watermark, created_at, updated_at`
+
+// scanGalleries reads and closes rows of galleryColumns.
+func scanGalleries(rows *sql.Rows) ([]Gallery, error) {
+	defer rows.Close()
+	m := pgtype.NewMap()
 	var galleries []Gallery
 	for rows.Next() {
-		gallery := Gallery{
-			UserID: userID,
-		}
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		gallery, err := scanGallery(rows, m)
 		if err != nil {
-			return nil, fmt.Errorf("query galleries by user: %w", err)
+			return nil, err
 		}
 		galleries = append(galleries, gallery)
 	}
-	if rows.Err() != nil {
-		return nil, fmt.Errorf("query galleries by user: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 	return galleries, nil
 }
 
-func (service *GalleryService) Update(gallery *Gallery) error {
-	_, err := service.DB.Exec(`
-		UPDATE galleries
-		SET title = $2
-		WHERE id = $1;
-	`, gallery.ID, gallery.Title)
+// scanGalleriesWithKey reads and closes rows of galleryColumns followed by
+// the value they are sorted by, as text.
+func scanGalleriesWithKey(rows *sql.Rows) ([]Gallery, []string, error) {
+	defer rows.Close()
+	m := pgtype.NewMap()
+	var galleries []Gallery
+	var keys []string
+	for rows.Next() {
+		var key string
+		gallery, err := scanGallery(rows, m, &key)
+		if err != nil {
+			return nil, nil, err
+		}
+		galleries = append(galleries, gallery)
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return galleries, keys, nil
+}
+
+// scanGallery reads the current row of galleryColumns, and any columns after
+// them into extra.
+func scanGallery(rows *sql.Rows, m *pgtype.Map, extra ...interface{}) (Gallery, error) {
+	var gallery Gallery
+	var collectionID sql.NullInt64
+	dest := []interface{}{&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Visibility, &gallery.AllowDownloads,
+		m.SQLScanner(&gallery.Tags), &collectionID, &gallery.CommentsRequireApproval, &gallery.Watermark,
+		&gallery.CreatedAt, &gallery.UpdatedAt}
+	err := rows.Scan(append(dest, extra...)...)
 	if err != nil {
-		return fmt.Errorf("update gallery: %w", err)
+		return Gallery{}, err
 	}
-	return nil
+	gallery.CollectionID = int(collectionID.Int64)
+	return gallery, nil
 }
 
-func (service *GalleryService) Delete(id int) error {
+func (service *GalleryService) Update(gallery *Gallery) error {
+	if gallery.Visibility != VisibilityPublic && gallery.Visibility != VisibilityPrivate {
+		return fmt.Errorf("update gallery: invalid visibility %q", gallery.Visibility)
+	}
+	if gallery.Tags == nil {
+		gallery.Tags = []string{}
+	}
 	_, err := service.DB.Exec(`
-		DELETE FROM galleries
+		UPDATE galleries
+		SET title = $2, visibility = $3, allow_downloads = $4, tags = $5, collection_id = nullif($6, 0),
+			comments_require_approval = $7, watermark = $8
 		WHERE id = $1;
-	`, id)
-	if err != nil {
-		return fmt.Errorf("delete gallery: %w", err)
-	}
-	err = os.RemoveAll(service.galleryDir(id))
+	`, gallery.ID, gallery.Title, gallery.Visibility, gallery.AllowDownloads, gallery.Tags, gallery.CollectionID,
+		gallery.CommentsRequireApproval, gallery.Watermark)
 	if err != nil {
-		return fmt.Errorf("delete gallery images: %w", err)
+		return fmt.Errorf("update gallery: %w", err)
 	}
-
 	return nil
 }
 
 func (service *GalleryService) Images(galleryID int) ([]Image, error) {
-	globPattern := filepath.Join(service.galleryDir(galleryID), "*")
-	allFiles, err := filepath.Glob(globPattern)
+	rows, err := service.DB.Query(`
+		SELECT public_id, filename, content_hash, caption, tags, rating, flag, color_label
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL
+		ORDER BY filename;
+	`, galleryID)
 	if err != nil {
 		return nil, fmt.Errorf("retrieving gallery images: %w", err)
 	}
+	images, err := scanImages(rows, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	return images, nil
+}
 
+// scanImages reads the images of a gallery selected with the columns of
+// Images, and closes rows.
+func scanImages(rows *sql.Rows, galleryID int) ([]Image, error) {
+	defer rows.Close()
+	m := pgtype.NewMap()
 	var images []Image
-	for _, file := range allFiles {
-		if hasExtension(file, service.extensions()) {
-			images = append(images, Image{
-				GalleryID: galleryID,
-				Path:      file,
-				Filename:  filepath.Base(file),
-			})
+	for rows.Next() {
+		image := Image{
+			GalleryID: galleryID,
+		}
+		err := rows.Scan(&image.ID, &image.Filename, &image.ContentHash, &image.Caption, m.SQLScanner(&image.Tags),
+			&image.Rating, &image.Flag, &image.ColorLabel)
+		if err != nil {
+			return nil, err
 		}
+		image.Key = blobKey(image.ContentHash)
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
-
 	return images, nil
 }
 
-func (service *GalleryService) Image(galleryID int, filename string) (Image, error) {
-	imagePath := filepath.Join(service.galleryDir(galleryID), filename)
-	_, err := os.Stat(imagePath)
+func (service *GalleryService) Image(galleryID int, id string) (Image, error) {
+	image := Image{
+		ID:        id,
+		GalleryID: galleryID,
+	}
+	row := service.DB.QueryRow(`
+		SELECT filename, content_hash, caption, tags, rating, flag, color_label
+		FROM images
+		WHERE gallery_id = $1 AND public_id = $2 AND deleted_at IS NULL;
+	`, galleryID, id)
+	err := row.Scan(&image.Filename, &image.ContentHash, &image.Caption, pgtype.NewMap().SQLScanner(&image.Tags),
+		&image.Rating, &image.Flag, &image.ColorLabel)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
+		if errors.Is(err, sql.ErrNoRows) {
 			return Image{}, ErrNotFound
 		}
 		return Image{}, fmt.Errorf("querying for image: %w", err)
 	}
+	image.Key = blobKey(image.ContentHash)
+
+	return image, nil
+}
 
-	return Image{
+// Cover returns the image that represents a gallery in listings, which is its
+// first image. ErrNotFound is returned for empty galleries.
+func (service *GalleryService) Cover(galleryID int) (Image, error) {
+	image := Image{
 		GalleryID: galleryID,
-		Path:      imagePath,
-		Filename:  filename,
-	}, nil
+	}
+	row := service.DB.QueryRow(`
+		SELECT public_id, filename, content_hash
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL
+		ORDER BY filename
+		LIMIT 1;
+	`, galleryID)
+	err := row.Scan(&image.ID, &image.Filename, &image.ContentHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("querying for gallery cover: %w", err)
+	}
+	image.Key = blobKey(image.ContentHash)
+	return image, nil
+}
+
+// UpdateImage saves the caption and tags of an image.
+func (service *GalleryService) UpdateImage(image *Image) error {
+	image.Caption = truncateRunes(strings.TrimSpace(image.Caption), MaxCaptionLength)
+	if image.Tags == nil {
+		image.Tags = []string{}
+	}
+	result, err := service.DB.Exec(`
+		UPDATE images
+		SET caption = $3, tags = $4
+		WHERE gallery_id = $1 AND public_id = $2 AND deleted_at IS NULL;
+	`, image.GalleryID, image.ID, image.Caption, image.Tags)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// OpenImage opens the file of an image for reading. Callers must close it.
+func (service *GalleryService) OpenImage(image Image) (io.ReadSeekCloser, StorageObject, error) {
+	obj, err := service.storage().Stat(image.Key)
+	if err != nil {
+		return nil, StorageObject{}, fmt.Errorf("opening image: %w", err)
+	}
+	f, err := service.storage().Get(image.Key)
+	if err != nil {
+		return nil, StorageObject{}, fmt.Errorf("opening image: %w", err)
+	}
+	return f, obj, nil
 }
 
-func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) error {
+// CreateImage stores an image in a gallery. The filename is sanitized, and
+// changed if another image of the gallery already uses it. If the gallery
+// already has an image with the exact same contents, nothing is stored and a
+// DuplicateImageError is returned instead.
+func (service *GalleryService) CreateImage(galleryID int, filename string, contents io.ReadSeeker) (*Image, error) {
+	filename = sanitizeFilename(filename)
 	err := checkContentType(contents, service.imageContentTypes())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 	err = checkExtension(filename, service.extensions())
 	if err != nil {
-		return fmt.Errorf("creating image %v: %w", filename, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
-	galleryDir := service.galleryDir(galleryID)
-	err = os.MkdirAll(galleryDir, 0755)
+	contentHash, perceptualHash, err := hashImage(contents)
 	if err != nil {
-		return fmt.Errorf("creating gallery-%d images directory: %w", galleryID, err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	size, err := contents.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = contents.Seek(0, io.SeekStart)
 	}
-	imagePath := filepath.Join(galleryDir, filename)
-	dst, err := os.Create(imagePath)
 	if err != nil {
-		return fmt.Errorf("creating image file: %w", err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, contents)
+	image := Image{
+		GalleryID:   galleryID,
+		Key:         blobKey(contentHash),
+		Filename:    filename,
+		ContentHash: contentHash,
+	}
+	err = service.insertImage(&image, perceptualHash, size, contents)
 	if err != nil {
-		return fmt.Errorf("copying contents to image: %w", err)
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
 	}
 
+	// Browsers without WebP support get a JPEG copy instead. Generate it now
+	// so the first request for the image doesn't have to.
+	if needsFallback(image.Filename) {
+		_, err = service.Fallback(image)
+		if err != nil {
+			return nil, fmt.Errorf("creating image %v: %w", filename, err)
+		}
+	}
+
+	return &image, nil
+}
+
+// CreateImageFromStream stores an image read from a stream that can't seek,
+// like a part of a multipart request. The content type and extension are
+// checked before anything is buffered, so invalid files are rejected without
+// reading them. Files larger than maxSize bytes are rejected with
+// ErrImageTooLarge, and the rest of them is not read.
+func (service *GalleryService) CreateImageFromStream(galleryID int, filename string, r io.Reader, maxSize int64) (*Image, error) {
+	filename = sanitizeFilename(filename)
+	err := checkExtension(filename, service.extensions())
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	head = head[:n]
+	err = checkSniffedContentType(head, service.imageContentTypes())
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	// The contents are hashed before they are stored, which needs them in
+	// full. Only this one file is buffered at a time.
+	tmp, err := os.CreateTemp("", "lenslocked-image-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	written, err := io.Copy(tmp, io.LimitReader(io.MultiReader(bytes.NewReader(head), r), maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+	if written > maxSize {
+		return nil, fmt.Errorf("creating image %v: %w", filename, ErrImageTooLarge)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, fmt.Errorf("creating image %v: %w", filename, err)
+	}
+
+	return service.CreateImage(galleryID, filename, tmp)
+}
+
+// insertImage records an image in a gallery and stores its contents as a
+// blob. The ID and final filename are set on the image. A
+// DuplicateImageError is returned if the gallery already has an image with
+// the same contents; the check holds the lock of the gallery, so two
+// identical uploads at the same time can't both pass it.
+func (service *GalleryService) insertImage(image *Image, perceptualHash uint64, size int64, contents io.Reader) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = lockGallery(tx, image.GalleryID)
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	existing, err := filenameByContentHash(tx, image.GalleryID, image.ContentHash)
+	if err == nil {
+		return fmt.Errorf("insert image: %w", DuplicateImageError{
+			Filename: image.Filename,
+			Existing: existing,
+		})
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	err = service.checkQuota(tx, image.GalleryID, size, Usage{})
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	image.Filename, err = uniqueFilename(tx, image.GalleryID, image.Filename)
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	image.ID, err = newImageID()
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+
+	err = service.retainBlob(tx, image.ContentHash, size, contents)
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO images (public_id, gallery_id, filename, content_hash, perceptual_hash)
+		VALUES ($1, $2, $3, $4, $5);
+	`, image.ID, image.GalleryID, image.Filename, image.ContentHash, int64(perceptualHash))
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("insert image: %w", err)
+	}
 	return nil
 }
 
-func (service *GalleryService) DeleteImage(galleryID int, filename string) error {
-	image, err := service.Image(galleryID, filename)
+// CopyImage adds an image to another gallery and returns the copy. Both
+// images share the same blob, so copying doesn't take any extra storage.
+func (service *GalleryService) CopyImage(image Image, galleryID int) (*Image, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("copy image: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = lockGallery(tx, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("copy image: %w", err)
+	}
+
+	var size int64
+	row := tx.QueryRow(`
+		SELECT size
+		FROM blobs
+		WHERE hash = $1;
+	`, image.ContentHash)
+	err = row.Scan(&size)
+	if err != nil {
+		return nil, fmt.Errorf("copy image: %w", err)
+	}
+	imageCopy, err := service.copyImage(tx, image, size, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("copy image: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("copy image: %w", err)
+	}
+	return &imageCopy, nil
+}
+
+// copyImage adds a copy of an image of the given size to a gallery, along
+// with its caption, tags and culling. Callers need to hold a lock on the
+// gallery. ErrNotFound is returned if the image has been deleted meanwhile,
+// and the reference to its blob is only taken once the copy exists.
+func (service *GalleryService) copyImage(tx *sql.Tx, image Image, size int64, galleryID int) (Image, error) {
+	err := service.checkQuota(tx, galleryID, size, Usage{})
+	if err != nil {
+		return Image{}, err
+	}
+
+	imageCopy := image
+	imageCopy.GalleryID = galleryID
+	imageCopy.Filename, err = uniqueFilename(tx, galleryID, image.Filename)
+	if err != nil {
+		return Image{}, err
+	}
+	imageCopy.ID, err = newImageID()
+	if err != nil {
+		return Image{}, err
+	}
+	result, err := tx.Exec(`
+		INSERT INTO images (public_id, gallery_id, filename, content_hash, perceptual_hash, caption, tags,
+			rating, flag, color_label)
+		SELECT $1, $2, $3, content_hash, perceptual_hash, caption, tags, rating, flag, color_label
+		FROM images
+		WHERE public_id = $4 AND content_hash = $5 AND deleted_at IS NULL;
+	`, imageCopy.ID, imageCopy.GalleryID, imageCopy.Filename, image.ID, image.ContentHash)
+	if err != nil {
+		return Image{}, err
+	}
+	err = checkRowsAffected(result, "copy image")
+	if err != nil {
+		return Image{}, err
+	}
+	err = service.addBlobRef(tx, image.ContentHash)
+	if err != nil {
+		return Image{}, err
+	}
+	return imageCopy, nil
+}
+
+// Fallback returns the JPEG version of an image that is stored in a format
+// not every browser can display. If the fallback is missing, it is generated
+// from the original.
+func (service *GalleryService) Fallback(image Image) (Image, error) {
+	if !needsFallback(image.Filename) {
+		return image, nil
+	}
+	fallback := Image{
+		GalleryID:   image.GalleryID,
+		Key:         variantKey(image.ContentHash, ".jpg"),
+		Filename:    image.Filename + ".jpg",
+		ContentHash: image.ContentHash,
+	}
+	err := service.variant(image, fallback.Key, encodeJPEGFallback)
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		return Image{}, fmt.Errorf("image fallback: %w", err)
+	}
+	return fallback, nil
+}
+
+// Resized returns a JPEG version of an image scaled down to fit the given
+// size. It is generated from the original the first time it is requested.
+func (service *GalleryService) Resized(image Image, size ImageSize) (Image, error) {
+	resized := Image{
+		GalleryID:   image.GalleryID,
+		Key:         variantKey(image.ContentHash, fmt.Sprintf("-%d.jpg", size.MaxDimension)),
+		Filename:    strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename)) + ".jpg",
+		ContentHash: image.ContentHash,
 	}
-	err = os.Remove(image.Path)
+	err := service.variant(image, resized.Key, func(dst io.Writer, src io.Reader) error {
+		return encodeResizedJPEG(dst, src, size.MaxDimension)
+	})
 	if err != nil {
-		return fmt.Errorf("deleting image: %w", err)
+		return Image{}, fmt.Errorf("resized image: %w", err)
 	}
+	return resized, nil
+}
 
+// variant makes sure the file derived from image with the given key exists,
+// creating it with encode if it doesn't.
+func (service *GalleryService) variant(image Image, key string, encode func(dst io.Writer, src io.Reader) error) error {
+	_, err := service.storage().Stat(key)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("querying for variant: %w", err)
+	}
+	src, err := service.storage().Get(image.Key)
+	if err != nil {
+		return fmt.Errorf("opening image: %w", err)
+	}
+	defer src.Close()
+	var buf bytes.Buffer
+	err = encode(&buf, src)
+	if err != nil {
+		return fmt.Errorf("creating variant: %w", err)
+	}
+	contents := buf.Bytes()
+	err = service.storage().Put(key, bytes.NewReader(contents))
+	if err != nil {
+		return fmt.Errorf("storing variant: %w", err)
+	}
+	// The checksum is what the scrubber verifies the variant against later.
+	err = service.recordVariant(key, image.ContentHash, contents)
+	if err != nil {
+		return fmt.Errorf("recording variant: %w", err)
+	}
 	return nil
 }
 
-func (service *GalleryService) galleryDir(id int) string {
-	imagesDir := service.ImageDir
-	if imagesDir == "" {
-		imagesDir = "images"
+// PossibleDuplicates groups the images across all galleries of a user that
+// look alike. Images land in the same group when their contents are
+// identical or their perceptual hashes are at most maxDistance bits apart.
+// Only groups with more than one image are returned.
+func (service *GalleryService) PossibleDuplicates(userID int, maxDistance int) ([][]Image, error) {
+	rows, err := service.DB.Query(`
+		SELECT i.public_id, i.gallery_id, i.filename, i.content_hash, i.perceptual_hash
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		WHERE g.user_id = $1 AND i.deleted_at IS NULL AND g.deleted_at IS NULL
+		ORDER BY i.gallery_id, i.filename;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query possible duplicates: %w", err)
+	}
+	defer rows.Close()
+
+	type hashedImage struct {
+		Image
+		perceptualHash uint64
+	}
+	var images []hashedImage
+	for rows.Next() {
+		var image hashedImage
+		var perceptualHash int64
+		err := rows.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.ContentHash, &perceptualHash)
+		if err != nil {
+			return nil, fmt.Errorf("query possible duplicates: %w", err)
+		}
+		image.perceptualHash = uint64(perceptualHash)
+		image.Key = blobKey(image.ContentHash)
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query possible duplicates: %w", err)
+	}
+
+	// Union-find over every pair of images. This is quadratic, which is fine
+	// for the few thousand images a single user has.
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			if images[i].ContentHash == images[j].ContentHash ||
+				hammingDistance(images[i].perceptualHash, images[j].perceptualHash) <= maxDistance {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	var groups [][]Image
+	groupIndex := make(map[int]int)
+	for i, image := range images {
+		root := find(i)
+		idx, ok := groupIndex[root]
+		if !ok {
+			idx = len(groups)
+			groupIndex[root] = idx
+			groups = append(groups, nil)
+		}
+		groups[idx] = append(groups[idx], image.Image)
+	}
+	var duplicates [][]Image
+	for _, group := range groups {
+		if len(group) > 1 {
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates, nil
+}
+
+func filenameByContentHash(tx *sql.Tx, galleryID int, contentHash string) (string, error) {
+	var filename string
+	row := tx.QueryRow(`
+		SELECT filename
+		FROM images
+		WHERE gallery_id = $1 AND content_hash = $2 AND deleted_at IS NULL
+		LIMIT 1;
+	`, galleryID, contentHash)
+	err := row.Scan(&filename)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", fmt.Errorf("query image by content hash: %w", err)
 	}
+	return filename, nil
+}
 
-	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+func (service *GalleryService) storage() Storage {
+	if service.Storage != nil {
+		return service.Storage
+	}
+	return &LocalStorage{Dir: service.ImageDir}
 }
 
 func (service *GalleryService) extensions() []string {
-	return []string{".png", ".jpg", ".jpeg", ".gif"}
+	return []string{".png", ".jpg", ".jpeg", ".gif", ".webp"}
 }
 
 func (service *GalleryService) imageContentTypes() []string {
-	return []string{"image/png", "image/jpeg", "image/gif"}
+	return []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+}
+
+// newImageID generates the random ID of an image.
+func newImageID() (string, error) {
+	// 12 bytes encode to 16 characters without base64 padding.
+	return rand.String(12)
+}
+
+// hashImage returns the hex encoded SHA-256 of the contents along with their
+// perceptual hash. The reader is rewound afterwards.
+func hashImage(contents io.ReadSeeker) (string, uint64, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, contents)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing image: %w", err)
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing image: %w", err)
+	}
+	perceptualHash, err := perceptualHash(contents)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing image: %w", err)
+	}
+	_, err = contents.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", 0, fmt.Errorf("hashing image: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), perceptualHash, nil
 }
 
 func hasExtension(file string, extensions []string) bool {
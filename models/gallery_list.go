@@ -0,0 +1,188 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Orders of the galleries listed by ListByUserID.
+const (
+	GallerySortNewest  = "newest"
+	GallerySortUpdated = "updated"
+	GallerySortTitle   = "title"
+	// GallerySortImages lists the galleries with the most images first.
+	GallerySortImages = "images"
+)
+
+const (
+	// DefaultGalleryPageSize is the number of galleries on a page when the
+	// listing options don't say.
+	DefaultGalleryPageSize = 25
+	// MaxGalleryPageSize is the most galleries listed on a page.
+	MaxGalleryPageSize = 100
+)
+
+var (
+	ErrInvalidCursor = errors.New("models: invalid page cursor")
+)
+
+// GallerySorts are the orders galleries can be listed in, the default first.
+var GallerySorts = []string{GallerySortNewest, GallerySortUpdated, GallerySortTitle, GallerySortImages}
+
+// gallerySortKeys are the expressions galleries are ordered by for each sort,
+// before their ID, along with the SQL type of the expression and whether the
+// order is descending.
+var gallerySortKeys = map[string]struct {
+	expr       string
+	sqlType    string
+	descending bool
+}{
+	GallerySortNewest:  {"created_at", "timestamptz", true},
+	GallerySortUpdated: {"updated_at", "timestamptz", true},
+	GallerySortTitle:   {"lower(coalesce(title, ''))", "text", false},
+	GallerySortImages:  {"image_count", "bigint", true},
+}
+
+// GalleryListOptions select, order and paginate the galleries of a user.
+type GalleryListOptions struct {
+	// Sort is one of GallerySorts, GallerySortNewest if empty.
+	Sort string
+	// Tag only lists the galleries with this tag, if set.
+	Tag string
+	// Visibility only lists the galleries with this visibility, if set.
+	Visibility string
+	// Limit is the number of galleries on a page, DefaultGalleryPageSize if
+	// 0.
+	Limit int
+	// After is the Next cursor of the previous page, or empty for the first
+	// page.
+	After string
+}
+
+// GalleryPage is a page of galleries listed by ListByUserID.
+type GalleryPage struct {
+	Galleries []Gallery
+	// Next is the cursor of the next page, or empty on the last page.
+	Next string
+}
+
+// galleryCursor is the position of the last gallery of a page: the value it
+// was ordered by, as text, and its ID.
+type galleryCursor struct {
+	Key string `json:"k"`
+	ID  int    `json:"id"`
+}
+
+// ListByUserID returns a page of the galleries of a user. Pages are
+// delimited by the last gallery of the previous one rather than an offset,
+// so galleries created or deleted meanwhile don't shift the pages.
+// ErrInvalidCursor is returned if opts.After wasn't made by ListByUserID
+// for the same sort.
+func (service *GalleryService) ListByUserID(userID int, opts GalleryListOptions) (GalleryPage, error) {
+	if opts.Sort == "" {
+		opts.Sort = GallerySortNewest
+	}
+	sortKey, ok := gallerySortKeys[opts.Sort]
+	if !ok {
+		return GalleryPage{}, fmt.Errorf("list galleries: invalid sort %q", opts.Sort)
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultGalleryPageSize
+	}
+	if opts.Limit > MaxGalleryPageSize {
+		opts.Limit = MaxGalleryPageSize
+	}
+	var after *galleryCursor
+	if opts.After != "" {
+		after = &galleryCursor{}
+		b, err := base64.RawURLEncoding.DecodeString(opts.After)
+		if err == nil {
+			err = json.Unmarshal(b, after)
+		}
+		if err != nil {
+			return GalleryPage{}, fmt.Errorf("list galleries: %w", ErrInvalidCursor)
+		}
+	}
+
+	order, compare := "ASC", ">"
+	if sortKey.descending {
+		order, compare = "DESC", "<"
+	}
+	// The cursor condition is left out of the first page.
+	query := `
+		SELECT ` + galleryColumns + `, ` + sortKey.expr + `::text
+		FROM (
+			SELECT g.*, (
+				SELECT count(*) FROM images i WHERE i.gallery_id = g.id AND i.deleted_at IS NULL
+			) AS image_count
+			FROM galleries g
+			WHERE g.user_id = $1 AND g.deleted_at IS NULL
+				AND ($2 = '' OR $2 = ANY(g.tags)) AND ($3 = '' OR g.visibility = $3)
+		) g
+		WHERE $4::text IS NULL OR (` + sortKey.expr + `, id) ` + compare + ` ($4::text::` + sortKey.sqlType + `, $5)
+		ORDER BY ` + sortKey.expr + ` ` + order + `, id ` + order + `
+		LIMIT $6;`
+	var cursorKey *string
+	var cursorID int
+	if after != nil {
+		cursorKey, cursorID = &after.Key, after.ID
+	}
+	var tag string
+	if tags := ParseTags(opts.Tag); len(tags) > 0 {
+		tag = tags[0]
+	}
+	// One more gallery than asked for tells whether there is a next page.
+	rows, err := service.DB.Query(query, userID, tag, opts.Visibility, cursorKey, cursorID, opts.Limit+1)
+	if err != nil {
+		if after != nil && isInvalidTextRepresentation(err) {
+			return GalleryPage{}, fmt.Errorf("list galleries: %w", ErrInvalidCursor)
+		}
+		return GalleryPage{}, fmt.Errorf("list galleries: %w", err)
+	}
+	galleries, keys, err := scanGalleriesWithKey(rows)
+	if err != nil {
+		return GalleryPage{}, fmt.Errorf("list galleries: %w", err)
+	}
+
+	page := GalleryPage{Galleries: galleries}
+	if len(galleries) > opts.Limit {
+		page.Galleries = galleries[:opts.Limit]
+		last := opts.Limit - 1
+		b, err := json.Marshal(galleryCursor{Key: keys[last], ID: galleries[last].ID})
+		if err != nil {
+			return GalleryPage{}, fmt.Errorf("list galleries: %w", err)
+		}
+		page.Next = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return page, nil
+}
+
+// TagsByUserID returns every tag used by the galleries of a user, in
+// alphabetical order.
+func (service *GalleryService) TagsByUserID(userID int) ([]string, error) {
+	rows, err := service.DB.Query(`
+		SELECT DISTINCT unnest(tags) AS tag
+		FROM galleries
+		WHERE user_id = $1 AND deleted_at IS NULL
+		ORDER BY tag;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query gallery tags: %w", err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		err := rows.Scan(&tag)
+		if err != nil {
+			return nil, fmt.Errorf("query gallery tags: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query gallery tags: %w", err)
+	}
+	return tags, nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+const (
+	// DefaultImagePageSize is the number of images on a page when ImagesPage
+	// isn't told.
+	DefaultImagePageSize = 48
+	// MaxImagePageSize is the most images on a page.
+	MaxImagePageSize = 200
+)
+
+// ImagePage is a page of the images of a gallery listed by ImagesPage.
+type ImagePage struct {
+	Images []Image
+	// Next is the cursor of the next page, or empty on the last page.
+	Next string
+}
+
+// ImageCursor returns the cursor of the page of ImagesPage starting with an
+// image. It holds the filename rather than the ID of the image, so it still
+// works once the image is moved to another gallery or deleted.
+func ImageCursor(image Image) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(image.Filename))
+}
+
+// ImagesPage returns a page of the images of a gallery, in the order of
+// Images, starting at the cursor from, made by ImageCursor, or with the
+// first image if from is empty. Pages are delimited by an image rather than
+// an offset, so images uploaded or deleted meanwhile don't shift them.
+// ErrInvalidCursor is returned if from wasn't made by ImageCursor.
+func (service *GalleryService) ImagesPage(galleryID int, from string, limit int) (ImagePage, error) {
+	if limit <= 0 {
+		limit = DefaultImagePageSize
+	}
+	if limit > MaxImagePageSize {
+		limit = MaxImagePageSize
+	}
+	var fromFilename *string
+	if from != "" {
+		b, err := base64.RawURLEncoding.DecodeString(from)
+		if err != nil {
+			return ImagePage{}, fmt.Errorf("images page: %w", ErrInvalidCursor)
+		}
+		filename := string(b)
+		fromFilename = &filename
+	}
+
+	// One more image than asked for is the first of the next page.
+	rows, err := service.DB.Query(`
+		SELECT public_id, filename, content_hash, caption, tags, rating, flag, color_label
+		FROM images
+		WHERE gallery_id = $1 AND deleted_at IS NULL AND ($2::text IS NULL OR filename >= $2)
+		ORDER BY filename
+		LIMIT $3;
+	`, galleryID, fromFilename, limit+1)
+	if err != nil {
+		return ImagePage{}, fmt.Errorf("images page: %w", err)
+	}
+	images, err := scanImages(rows, galleryID)
+	if err != nil {
+		return ImagePage{}, fmt.Errorf("images page: %w", err)
+	}
+
+	page := ImagePage{Images: images}
+	if len(images) > limit {
+		page.Images = images[:limit]
+		page.Next = ImageCursor(images[limit])
+	}
+	return page, nil
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	ErrArchiveTooLarge   = errors.New("models: archive is too large")
+	ErrUnsafeArchivePath = errors.New("models: archive entry has an unsafe path")
+	// ErrSuspiciousCompression is returned for archive entries that expand
+	// far more than images do, which is how zip bombs work.
+	ErrSuspiciousCompression = errors.New("models: archive entry is compressed suspiciously well")
+)
+
+// ArchiveLimits bound the work done to import an archive, so a small upload
+// can't fill the disk or keep the server busy.
+type ArchiveLimits struct {
+	// MaxArchiveSize is the size of the archive itself.
+	MaxArchiveSize int64
+	MaxEntries     int
+	// MaxFileSize is the uncompressed size of a single entry.
+	MaxFileSize int64
+	// MaxTotalSize is the uncompressed size of all entries together.
+	MaxTotalSize int64
+	// MaxCompressionRatio is how many times larger than its compressed size
+	// an entry may be.
+	MaxCompressionRatio int64
+}
+
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxArchiveSize:      1 << 30, // 1gb
+	MaxEntries:          5000,
+	MaxFileSize:         50 << 20, // 50mb
+	MaxTotalSize:        4 << 30,  // 4gb
+	MaxCompressionRatio: 100,
+}
+
+// ImportedEntry reports what happened to one file of an imported archive.
+type ImportedEntry struct {
+	// Name is the path of the file within the archive.
+	Name string
+	// Image is the image that was created, or nil if the file was skipped.
+	Image *Image
+	// Err explains why the file was skipped.
+	Err error
+}
+
+// ImportArchive adds the images in a ZIP archive to a gallery. The archive is
+// read from r into a temporary file, as ZIP can only be read with random
+// access. Folders inside the archive are flattened, and files that aren't
+// valid images are skipped and reported with the reason in their Err.
+//
+// The archive as a whole is rejected if it breaks limits, before any image is
+// stored.
+func (service *GalleryService) ImportArchive(galleryID int, r io.Reader, limits ArchiveLimits) ([]ImportedEntry, error) {
+	tmp, err := os.CreateTemp("", "lenslocked-import-*.zip")
+	if err != nil {
+		return nil, fmt.Errorf("import archive: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, io.LimitReader(r, limits.MaxArchiveSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("import archive: %w", err)
+	}
+	if size > limits.MaxArchiveSize {
+		return nil, fmt.Errorf("import archive: %w", ErrArchiveTooLarge)
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return nil, fmt.Errorf("import archive: %w", err)
+	}
+
+	// Sizes in the archive are only claims, but archive/zip fails reading
+	// an entry that turns out larger than it claimed, so checking them up
+	// front is enough.
+	if len(zr.File) > limits.MaxEntries {
+		return nil, fmt.Errorf("import archive: %d entries: %w", len(zr.File), ErrArchiveTooLarge)
+	}
+	var total uint64
+	for _, f := range zr.File {
+		total += f.UncompressedSize64
+	}
+	if total > uint64(limits.MaxTotalSize) {
+		return nil, fmt.Errorf("import archive: %d bytes uncompressed: %w", total, ErrArchiveTooLarge)
+	}
+
+	var entries []ImportedEntry
+	for _, f := range zr.File {
+		if ignoreArchiveEntry(f) {
+			continue
+		}
+		entry := ImportedEntry{Name: f.Name}
+		entry.Image, entry.Err = service.importArchiveEntry(galleryID, f, limits)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (service *GalleryService) importArchiveEntry(galleryID int, f *zip.File, limits ArchiveLimits) (*Image, error) {
+	name, err := archiveEntryName(f.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !f.Mode().IsRegular() {
+		return nil, fmt.Errorf("importing %v: %w", name, ErrUnsafeArchivePath)
+	}
+	if f.UncompressedSize64 > uint64(limits.MaxFileSize) {
+		return nil, fmt.Errorf("importing %v: %w", name, ErrImageTooLarge)
+	}
+	if f.CompressedSize64 == 0 && f.UncompressedSize64 > 0 ||
+		f.CompressedSize64 > 0 && f.UncompressedSize64/f.CompressedSize64 > uint64(limits.MaxCompressionRatio) {
+		return nil, fmt.Errorf("importing %v: %w", name, ErrSuspiciousCompression)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("importing %v: %w", name, err)
+	}
+	defer rc.Close()
+	return service.CreateImageFromStream(galleryID, path.Base(name), rc, limits.MaxFileSize)
+}
+
+// archiveEntryName cleans up the path of an archive entry. Nothing is ever
+// written to disk under this path, but entries trying to escape the archive
+// with absolute paths or ".." are rejected anyway, as no honest archive
+// contains them.
+func archiveEntryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	// A drive letter, like "C:", makes a path absolute on Windows.
+	if path.IsAbs(name) || len(name) >= 2 && name[1] == ':' {
+		return "", fmt.Errorf("importing %v: %w", name, ErrUnsafeArchivePath)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("importing %v: %w", name, ErrUnsafeArchivePath)
+		}
+	}
+	return name, nil
+}
+
+// ignoreArchiveEntry reports whether an archive entry should be skipped
+// without mention: folders, and metadata added by operating systems rather
+// than by the user.
+func ignoreArchiveEntry(f *zip.File) bool {
+	if f.Mode().IsDir() || strings.HasSuffix(f.Name, "/") {
+		return true
+	}
+	name := strings.ReplaceAll(f.Name, `\`, "/")
+	base := path.Base(name)
+	return strings.HasPrefix(name, "__MACOSX/") ||
+		strings.HasPrefix(base, "._") ||
+		base == ".DS_Store" ||
+		base == "Thumbs.db"
+}
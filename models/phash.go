@@ -0,0 +1,83 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+)
+
+const (
+	// Two images whose perceptual hashes differ in at most this many bits are
+	// considered possible duplicates. Out of 64 bits, 10 catches resized and
+	// re-compressed exports without grouping unrelated photos.
+	DefaultDuplicateDistance = 10
+)
+
+// perceptualHash computes a difference hash (dHash) of an image. The image is
+// shrunk to 9x8 grayscale pixels and each bit records whether a pixel is
+// brighter than its right neighbour, so the hash survives resizing, format
+// changes and small edits.
+func perceptualHash(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, fmt.Errorf("perceptual hash: %w", err)
+	}
+
+	const w, h = 9, 8
+	var gray [h][w]float64
+	bounds := img.Bounds()
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/h
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/w
+			gray[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// averageLuma returns the mean luminance of the pixels in [x0,x1)x[y0,y1).
+// Large cells are sampled on a grid of at most 32x32 pixels, which is plenty
+// for a 9x8 hash and keeps hashing big photos fast. Tiny images may produce
+// empty cells, in which case the top left pixel of the cell is used.
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+	stepX := (x1-x0)/32 + 1
+	stepY := (y1-y0)/32 + 1
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+// hammingDistance returns the number of bits that differ between two hashes.
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
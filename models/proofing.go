@@ -0,0 +1,231 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const MaxNoteLength = 2000
+
+var (
+	ErrSelectionSubmitted = errors.New("models: selection has already been submitted")
+	ErrSelectionFull      = errors.New("models: selection is full")
+)
+
+// ProofMark is what a client marked on an image while proofing a gallery
+// through a share link.
+type ProofMark struct {
+	// ImageID is the public ID of the image.
+	ImageID  string
+	Filename string
+	Favorite bool
+	Note     string
+}
+
+// ProofingService keeps the favorites and notes of clients. Each share link
+// has its own selection, which locks once the client submits it.
+type ProofingService struct {
+	DB *sql.DB
+}
+
+// Marks returns the images of a share link's gallery that the client picked
+// as a favorite or left a note on, by filename.
+func (service *ProofingService) Marks(shareLinkID int) ([]ProofMark, error) {
+	rows, err := service.DB.Query(`
+		SELECT i.public_id, i.filename, m.favorite, m.note
+		FROM proof_marks m
+		JOIN images i ON i.id = m.image_id
+		WHERE m.share_link_id = $1 AND (m.favorite OR m.note <> '') AND i.deleted_at IS NULL
+		ORDER BY i.filename, i.public_id;
+	`, shareLinkID)
+	if err != nil {
+		return nil, fmt.Errorf("query proof marks: %w", err)
+	}
+	defer rows.Close()
+
+	var marks []ProofMark
+	for rows.Next() {
+		var mark ProofMark
+		err := rows.Scan(&mark.ImageID, &mark.Filename, &mark.Favorite, &mark.Note)
+		if err != nil {
+			return nil, fmt.Errorf("query proof marks: %w", err)
+		}
+		marks = append(marks, mark)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query proof marks: %w", err)
+	}
+	return marks, nil
+}
+
+// SetFavorite adds an image to, or removes it from, the favorites of a share
+// link. It fails with ErrSelectionFull when adding would pick more images
+// than the link allows, and with ErrSelectionSubmitted once the selection
+// has been submitted.
+func (service *ProofingService) SetFavorite(link *ShareLink, imageID string, favorite bool) error {
+	return service.mark(link, imageID, func(tx *sql.Tx, maxFavorites int) (sql.Result, error) {
+		if favorite && maxFavorites > 0 {
+			var count int
+			row := tx.QueryRow(`
+				SELECT count(*)
+				FROM proof_marks m
+				JOIN images i ON i.id = m.image_id
+				WHERE m.share_link_id = $1 AND m.favorite AND i.public_id <> $2 AND i.deleted_at IS NULL;
+			`, link.ID, imageID)
+			err := row.Scan(&count)
+			if err != nil {
+				return nil, err
+			}
+			if count >= maxFavorites {
+				return nil, ErrSelectionFull
+			}
+		}
+		return tx.Exec(`
+			INSERT INTO proof_marks (share_link_id, image_id, favorite)
+			SELECT $1, i.id, $4
+			FROM images i
+			WHERE i.gallery_id = $2 AND i.public_id = $3 AND i.deleted_at IS NULL
+			ON CONFLICT (share_link_id, image_id) DO UPDATE SET favorite = excluded.favorite;
+		`, link.ID, link.GalleryID, imageID, favorite)
+	})
+}
+
+// SetNote saves the note of a share link's client on an image. An empty note
+// removes it.
+func (service *ProofingService) SetNote(link *ShareLink, imageID, note string) error {
+	note = truncateRunes(strings.TrimSpace(note), MaxNoteLength)
+	return service.mark(link, imageID, func(tx *sql.Tx, maxFavorites int) (sql.Result, error) {
+		return tx.Exec(`
+			INSERT INTO proof_marks (share_link_id, image_id, note)
+			SELECT $1, i.id, $4
+			FROM images i
+			WHERE i.gallery_id = $2 AND i.public_id = $3 AND i.deleted_at IS NULL
+			ON CONFLICT (share_link_id, image_id) DO UPDATE SET note = excluded.note;
+		`, link.ID, link.GalleryID, imageID, note)
+	})
+}
+
+// mark runs update in a transaction that holds the share link, so the
+// selection can't be submitted, or fill up, while it is being changed.
+func (service *ProofingService) mark(link *ShareLink, imageID string, update func(tx *sql.Tx, maxFavorites int) (sql.Result, error)) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("mark image: %w", err)
+	}
+	defer tx.Rollback()
+
+	var maxFavorites int
+	var submittedAt sql.NullTime
+	row := tx.QueryRow(`
+		SELECT max_favorites, submitted_at
+		FROM share_links
+		WHERE id = $1
+		FOR UPDATE;
+	`, link.ID)
+	err = row.Scan(&maxFavorites, &submittedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("mark image: %w", err)
+	}
+	if submittedAt.Valid {
+		return fmt.Errorf("mark image: %w", ErrSelectionSubmitted)
+	}
+
+	result, err := update(tx, maxFavorites)
+	if err != nil {
+		return fmt.Errorf("mark image: %w", err)
+	}
+	err = checkRowsAffected(result, "mark image")
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("mark image: %w", err)
+	}
+	return nil
+}
+
+// Submit locks the selection of a share link.
+func (service *ProofingService) Submit(link *ShareLink) error {
+	row := service.DB.QueryRow(`
+		UPDATE share_links
+		SET submitted_at = now()
+		WHERE id = $1 AND submitted_at IS NULL
+		RETURNING submitted_at;
+	`, link.ID)
+	err := row.Scan(&link.SubmittedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("submit selection: %w", ErrSelectionSubmitted)
+		}
+		return fmt.Errorf("submit selection: %w", err)
+	}
+	return nil
+}
+
+// Reopen unlocks a submitted selection so the client can change it.
+func (service *ProofingService) Reopen(galleryID, shareLinkID int) error {
+	result, err := service.DB.Exec(`
+		UPDATE share_links
+		SET submitted_at = NULL
+		WHERE gallery_id = $1 AND id = $2;
+	`, galleryID, shareLinkID)
+	if err != nil {
+		return fmt.Errorf("reopen selection: %w", err)
+	}
+	return checkRowsAffected(result, "reopen selection")
+}
+
+// Favorites returns the marks of the images picked as favorites.
+func Favorites(marks []ProofMark) []ProofMark {
+	var favorites []ProofMark
+	for _, mark := range marks {
+		if mark.Favorite {
+			favorites = append(favorites, mark)
+		}
+	}
+	return favorites
+}
+
+// WriteSelectionCSV writes the favorites among marks as CSV, with a header
+// row, one row per image and the client's note on it.
+func WriteSelectionCSV(w io.Writer, marks []ProofMark) error {
+	cw := csv.NewWriter(w)
+	records := [][]string{{"filename", "note"}}
+	for _, mark := range Favorites(marks) {
+		records = append(records, []string{csvCell(mark.Filename), csvCell(mark.Note)})
+	}
+	err := cw.WriteAll(records)
+	if err != nil {
+		return fmt.Errorf("write selection csv: %w", err)
+	}
+	return nil
+}
+
+// csvCell keeps spreadsheets from running text written by clients as a
+// formula, by prefixing a ' to text starting like one.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// LightroomSearch returns the favorites among marks as a string to paste in
+// the Lightroom Library Filter, searching filenames that contain any of
+// them. Extensions are left out so raw files and their JPEGs both match.
+func LightroomSearch(marks []ProofMark) string {
+	var names []string
+	for _, mark := range Favorites(marks) {
+		names = append(names, strings.TrimSuffix(mark.Filename, path.Ext(mark.Filename)))
+	}
+	return strings.Join(names, ", ")
+}
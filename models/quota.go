@@ -0,0 +1,216 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Quota limits how much can be uploaded. Zero values mean no limit.
+type Quota struct {
+	MaxBytes  int64
+	MaxImages int
+}
+
+// Usage is the storage used by a user or gallery. Images are counted at their
+// full size even when their blob is shared with other images, so copying a
+// gallery counts against the quota like uploading it again would.
+type Usage struct {
+	Bytes  int64
+	Images int
+}
+
+// QuotaError is returned when storing an image would take a user or gallery
+// over its quota.
+type QuotaError struct {
+	// Scope is either "account" or "gallery".
+	Scope string
+	Quota Quota
+	Usage Usage
+}
+
+func (qe QuotaError) Error() string {
+	return fmt.Sprintf("%s quota exceeded: using %d bytes in %d images, limit is %d bytes in %d images",
+		qe.Scope, qe.Usage.Bytes, qe.Usage.Images, qe.Quota.MaxBytes, qe.Quota.MaxImages)
+}
+
+// exceeds reports whether adding an image of the given size would go over
+// the quota.
+func (q Quota) exceeds(usage Usage, size int64) bool {
+	if q.MaxBytes > 0 && usage.Bytes+size > q.MaxBytes {
+		return true
+	}
+	if q.MaxImages > 0 && usage.Images+1 > q.MaxImages {
+		return true
+	}
+	return false
+}
+
+// UserUsage returns the storage used by all galleries of a user.
+func (service *GalleryService) UserUsage(userID int) (Usage, error) {
+	usage, err := userUsage(service.DB, userID)
+	if err != nil {
+		return Usage{}, fmt.Errorf("user usage: %w", err)
+	}
+	return usage, nil
+}
+
+// GalleryUsages returns the storage used by the images shown in each gallery
+// of a user, keyed by gallery ID. Trashed images are left out, like on the
+// gallery page, and only count toward UserUsage. Galleries without images
+// are left out.
+func (service *GalleryService) GalleryUsages(userID int) (map[int]Usage, error) {
+	rows, err := service.DB.Query(`
+		SELECT i.gallery_id, count(*), COALESCE(sum(b.size), 0)
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		LEFT JOIN blobs b ON b.hash = i.content_hash
+		WHERE g.user_id = $1 AND i.deleted_at IS NULL
+		GROUP BY i.gallery_id;
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("gallery usages: %w", err)
+	}
+	defer rows.Close()
+
+	usages := make(map[int]Usage)
+	for rows.Next() {
+		var galleryID int
+		var usage Usage
+		err := rows.Scan(&galleryID, &usage.Images, &usage.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("gallery usages: %w", err)
+		}
+		usages[galleryID] = usage
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("gallery usages: %w", err)
+	}
+	return usages, nil
+}
+
+// checkQuota returns a QuotaError if adding an image of the given size to a
+// gallery would exceed the user or gallery quota. If the image replaces
+// another one, its usage is given in replaced so it isn't counted twice.
+//
+// The row of the gallery owner is locked until the transaction ends, so
+// concurrent uploads of the same user can't both squeeze under the quota.
+func (service *GalleryService) checkQuota(tx *sql.Tx, galleryID int, size int64, replaced Usage) error {
+	if service.UserQuota == (Quota{}) && service.GalleryQuota == (Quota{}) {
+		return nil
+	}
+
+	var userID int
+	row := tx.QueryRow(`
+		SELECT u.id
+		FROM users u
+		JOIN galleries g ON g.user_id = u.id
+		WHERE g.id = $1
+		FOR UPDATE OF u;
+	`, galleryID)
+	err := row.Scan(&userID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+
+	usage, err := userUsage(tx, userID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	usage.Bytes -= replaced.Bytes
+	usage.Images -= replaced.Images
+	if service.UserQuota.exceeds(usage, size) {
+		return QuotaError{Scope: "account", Quota: service.UserQuota, Usage: usage}
+	}
+	return service.checkGalleryQuota(tx, galleryID, size, replaced)
+}
+
+// checkGalleryQuota is like checkQuota for the gallery quota only, as when
+// an image moves between galleries of the same user.
+func (service *GalleryService) checkGalleryQuota(tx *sql.Tx, galleryID int, size int64, replaced Usage) error {
+	if service.GalleryQuota == (Quota{}) {
+		return nil
+	}
+
+	var usage Usage
+	row := tx.QueryRow(`
+		SELECT count(*), COALESCE(sum(b.size), 0)
+		FROM images i
+		LEFT JOIN blobs b ON b.hash = i.content_hash
+		WHERE i.gallery_id = $1;
+	`, galleryID)
+	err := row.Scan(&usage.Images, &usage.Bytes)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	usage.Bytes -= replaced.Bytes
+	usage.Images -= replaced.Images
+	if service.GalleryQuota.exceeds(usage, size) {
+		return QuotaError{Scope: "gallery", Quota: service.GalleryQuota, Usage: usage}
+	}
+	return nil
+}
+
+// checkTransferQuota returns a QuotaError if a gallery, trash included,
+// would take the user it is transferred to over the user quota. The row of
+// the user is locked like in checkQuota.
+func (service *GalleryService) checkTransferQuota(tx *sql.Tx, galleryID, toUserID int) error {
+	if service.UserQuota == (Quota{}) {
+		return nil
+	}
+
+	var id int
+	row := tx.QueryRow(`
+		SELECT id
+		FROM users
+		WHERE id = $1
+		FOR UPDATE;
+	`, toUserID)
+	err := row.Scan(&id)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	usage, err := userUsage(tx, toUserID)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	var gallery Usage
+	row = tx.QueryRow(`
+		SELECT count(*), COALESCE(sum(b.size), 0)
+		FROM images i
+		LEFT JOIN blobs b ON b.hash = i.content_hash
+		WHERE i.gallery_id = $1;
+	`, galleryID)
+	err = row.Scan(&gallery.Images, &gallery.Bytes)
+	if err != nil {
+		return fmt.Errorf("check quota: %w", err)
+	}
+	quota := service.UserQuota
+	if (quota.MaxBytes > 0 && usage.Bytes+gallery.Bytes > quota.MaxBytes) ||
+		(quota.MaxImages > 0 && usage.Images+gallery.Images > quota.MaxImages) {
+		return QuotaError{Scope: "account", Quota: quota, Usage: usage}
+	}
+	return nil
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// userUsage counts the images of a user, including those in the trash, since
+// their files are kept until the trash is emptied.
+func userUsage(db queryRower, userID int) (Usage, error) {
+	var usage Usage
+	row := db.QueryRow(`
+		SELECT count(i.id), COALESCE(sum(b.size), 0)
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		LEFT JOIN blobs b ON b.hash = i.content_hash
+		WHERE g.user_id = $1;
+	`, userID)
+	err := row.Scan(&usage.Images, &usage.Bytes)
+	if err != nil {
+		return Usage{}, err
+	}
+	return usage, nil
+}
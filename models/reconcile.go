@@ -0,0 +1,426 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Files younger than this are left out of reconciliation, since uploads
+	// store their file before the transaction recording it commits.
+	reconcileGracePeriod = time.Hour
+)
+
+// Kinds of problems Reconcile finds between the database and image storage.
+const (
+	// A file in storage that no blob or gallery refers to.
+	ProblemOrphanFile = "orphan file"
+	// A blob whose file is missing from storage.
+	ProblemMissingFile = "missing file"
+	// A blob whose file doesn't have the size the database records.
+	ProblemSizeMismatch = "size mismatch"
+	// A blob whose reference count doesn't match the images using it, which
+	// could let garbage collection delete a file still in use.
+	ProblemRefCount = "wrong reference count"
+	// Images whose blob isn't recorded in the database.
+	ProblemMissingBlob = "missing blob"
+)
+
+// ReconcileProblem is a mismatch between the database and image storage.
+type ReconcileProblem struct {
+	Kind string
+	// Key is the storage key of the file concerned.
+	Key    string
+	Detail string
+	// Repaired is set once the problem has been fixed. Problems that can't
+	// be fixed, like a missing file still used by images, need a backup.
+	Repaired bool
+	// RepairErr is set when fixing the problem failed.
+	RepairErr error
+}
+
+func (problem ReconcileProblem) String() string {
+	s := fmt.Sprintf("%s: %s: %s", problem.Kind, problem.Key, problem.Detail)
+	switch {
+	case problem.Repaired:
+		s += " (repaired)"
+	case problem.RepairErr != nil:
+		s += fmt.Sprintf(" (repair failed: %v)", problem.RepairErr)
+	}
+	return s
+}
+
+type ReconcileReport struct {
+	Files    int
+	Blobs    int
+	Problems []ReconcileProblem
+}
+
+// reconcileBlob is a row of the blobs table, along with the number of images
+// actually using it.
+type reconcileBlob struct {
+	size     int64
+	refCount int
+	images   int
+}
+
+// Reconcile compares the blobs and galleries in the database with the files
+// in image storage, and reports orphan files, missing files, sizes that
+// don't match and wrong reference counts. Unless repair is set, nothing is
+// changed. Otherwise every problem that can be fixed safely is: orphan files
+// are deleted, counts and sizes are corrected from the storage and images,
+// and rows of blobs that are gone and unused are removed.
+func (service *GalleryService) Reconcile(repair bool) (ReconcileReport, error) {
+	var report ReconcileReport
+	// The database is read first, so blobs stored meanwhile only show up as
+	// new files, which are skipped.
+	blobs, err := service.reconcileBlobs()
+	if err != nil {
+		return report, fmt.Errorf("reconcile: %w", err)
+	}
+	report.Blobs = len(blobs)
+	objects, err := service.storage().List("")
+	if err != nil {
+		return report, fmt.Errorf("reconcile: %w", err)
+	}
+	report.Files = len(objects)
+	files := make(map[string]StorageObject)
+	for _, obj := range objects {
+		files[obj.Key] = obj
+	}
+	galleryIDs, err := service.allGalleryIDs()
+	if err != nil {
+		return report, fmt.Errorf("reconcile: %w", err)
+	}
+
+	add := func(problem ReconcileProblem, fix func() error) {
+		if repair && fix != nil {
+			problem.RepairErr = fix()
+			problem.Repaired = problem.RepairErr == nil
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	cutoff := time.Now().Add(-reconcileGracePeriod)
+	for hash, blob := range blobs {
+		key := blobKey(hash)
+		obj, exists := files[key]
+		switch {
+		case blob.size < 0:
+			// Images refer to a blob that has no row.
+			problem := ReconcileProblem{
+				Kind:   ProblemMissingBlob,
+				Key:    key,
+				Detail: fmt.Sprintf("used by %d images", blob.images),
+			}
+			if !exists {
+				problem.Detail += ", and the file is missing"
+				add(problem, nil)
+				continue
+			}
+			add(problem, func() error { return service.restoreBlobRow(hash) })
+			continue
+		case !exists:
+			problem := ReconcileProblem{Kind: ProblemMissingFile, Key: key}
+			if blob.images > 0 {
+				problem.Detail = fmt.Sprintf("used by %d images, restore it from a backup", blob.images)
+				add(problem, nil)
+			} else {
+				problem.Detail = "not used by any image"
+				add(problem, func() error { return service.deleteMissingBlob(hash) })
+			}
+			continue
+		case obj.Size != blob.size:
+			add(ReconcileProblem{
+				Kind:   ProblemSizeMismatch,
+				Key:    key,
+				Detail: fmt.Sprintf("%d bytes in storage, %d recorded", obj.Size, blob.size),
+			}, func() error { return service.fixBlobSize(hash) })
+		}
+		if blob.refCount != blob.images {
+			add(ReconcileProblem{
+				Kind:   ProblemRefCount,
+				Key:    key,
+				Detail: fmt.Sprintf("counted %d references, used by %d images", blob.refCount, blob.images),
+			}, func() error { return service.fixBlobRefCount(hash) })
+		}
+	}
+
+	for _, obj := range objects {
+		if obj.ModTime.After(cutoff) {
+			continue
+		}
+		detail, orphan := orphanFile(obj.Key, blobs, galleryIDs)
+		if !orphan {
+			continue
+		}
+		key := obj.Key
+		add(ReconcileProblem{
+			Kind:   ProblemOrphanFile,
+			Key:    key,
+			Detail: detail,
+		}, func() error { return service.deleteOrphanFile(key) })
+	}
+	return report, nil
+}
+
+// orphanFile reports whether nothing in the database refers to the file with
+// the given key, and why. Files in unknown places are left alone, since they
+// weren't stored by this application.
+func orphanFile(key string, blobs map[string]reconcileBlob, galleryIDs map[int]bool) (string, bool) {
+	switch {
+	case strings.HasPrefix(key, "blobs/"):
+		hash := key[strings.LastIndex(key, "/")+1:]
+		if _, ok := blobs[hash]; !ok {
+			return "no blob recorded", true
+		}
+	case strings.HasPrefix(key, "variants/"):
+		hash := variantHash(key)
+		if _, ok := blobs[hash]; !ok {
+			return "variant of a blob that doesn't exist", true
+		}
+	case strings.HasPrefix(key, "gallery-"):
+		// Files of existing galleries are moved by ImportLegacyImages.
+		dir, _, _ := strings.Cut(key, "/")
+		id, err := strconv.Atoi(strings.TrimPrefix(dir, "gallery-"))
+		if err == nil && !galleryIDs[id] {
+			return "gallery doesn't exist", true
+		}
+	}
+	return "", false
+}
+
+// variantHash returns the hash of the blob a variant was made from. Hashes
+// are hex encoded SHA-256, 64 characters long, followed by what the variant
+// is.
+func variantHash(key string) string {
+	name := key[strings.LastIndex(key, "/")+1:]
+	if len(name) < 64 {
+		return name
+	}
+	return name[:64]
+}
+
+// reconcileBlobs returns every blob by hash, including those images refer to
+// without a row, which get a negative size.
+func (service *GalleryService) reconcileBlobs() (map[string]reconcileBlob, error) {
+	rows, err := service.DB.Query(`
+		SELECT coalesce(b.hash, i.content_hash), coalesce(b.size, -1), coalesce(b.ref_count, 0), count(i.id)
+		FROM blobs b
+		FULL JOIN images i ON i.content_hash = b.hash
+		GROUP BY 1, 2, 3;
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blobs := make(map[string]reconcileBlob)
+	for rows.Next() {
+		var hash string
+		var blob reconcileBlob
+		err := rows.Scan(&hash, &blob.size, &blob.refCount, &blob.images)
+		if err != nil {
+			return nil, err
+		}
+		blobs[hash] = blob
+	}
+	return blobs, rows.Err()
+}
+
+// allGalleryIDs returns the IDs of every gallery, including those in the
+// trash.
+func (service *GalleryService) allGalleryIDs() (map[int]bool, error) {
+	rows, err := service.DB.Query(`SELECT id FROM galleries;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// The repairs below check the problem again while holding the lock of the
+// blob, since uploads and garbage collection may have fixed it meanwhile.
+
+// fixBlobRefCount sets the reference count of a blob to the number of images
+// using it.
+func (service *GalleryService) fixBlobRefCount(hash string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = lockBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE blobs
+		SET
+			ref_count = (SELECT count(*) FROM images WHERE content_hash = $1),
+			unreferenced_at = CASE
+				WHEN (SELECT count(*) FROM images WHERE content_hash = $1) = 0 THEN coalesce(unreferenced_at, now())
+			END
+		WHERE hash = $1;
+	`, hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fixBlobSize records the size of the file of a blob, once its contents are
+// checked against the hash. A file whose contents don't match can't be
+// repaired.
+func (service *GalleryService) fixBlobSize(hash string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = lockBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	size, err := service.checkBlobFile(hash)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE blobs
+		SET size = $2
+		WHERE hash = $1;
+	`, hash, size)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// restoreBlobRow records a blob that images use and whose file exists.
+func (service *GalleryService) restoreBlobRow(hash string) error {
+	size, err := service.checkBlobFile(hash)
+	if err != nil {
+		return err
+	}
+	_, err = service.DB.Exec(`
+		INSERT INTO blobs (hash, size, ref_count)
+		VALUES ($1, $2, (SELECT count(*) FROM images WHERE content_hash = $1))
+		ON CONFLICT (hash) DO NOTHING;
+	`, hash, size)
+	return err
+}
+
+// deleteMissingBlob removes the row of a blob whose file is gone, as long as
+// no image uses it.
+func (service *GalleryService) deleteMissingBlob(hash string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = lockBlob(tx, hash)
+	if err != nil {
+		return err
+	}
+	_, err = service.storage().Stat(blobKey(hash))
+	if err == nil {
+		return fmt.Errorf("the file exists again")
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	result, err := tx.Exec(`
+		DELETE FROM blobs
+		WHERE hash = $1 AND NOT EXISTS (SELECT 1 FROM images WHERE content_hash = $1);
+	`, hash)
+	if err != nil {
+		return err
+	}
+	err = checkRowsAffected(result, "delete missing blob")
+	if err != nil {
+		return fmt.Errorf("the blob has changed meanwhile")
+	}
+	return tx.Commit()
+}
+
+// deleteOrphanFile deletes a file nothing refers to.
+func (service *GalleryService) deleteOrphanFile(key string) error {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists bool
+	switch {
+	case strings.HasPrefix(key, "blobs/"):
+		exists, err = lockBlob(tx, key[strings.LastIndex(key, "/")+1:])
+	case strings.HasPrefix(key, "variants/"):
+		exists, err = lockBlob(tx, variantHash(key))
+	}
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("the blob has been recorded since")
+	}
+	err = service.storage().Delete(key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM variants
+		WHERE key = $1;
+	`, key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// lockBlob locks the row of a blob until the transaction ends, and reports
+// whether it exists.
+func lockBlob(tx *sql.Tx, hash string) (bool, error) {
+	var exists bool
+	row := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM blobs WHERE hash = $1 FOR UPDATE
+		);
+	`, hash)
+	err := row.Scan(&exists)
+	return exists, err
+}
+
+// checkBlobFile hashes the file of a blob and returns its size, or an error
+// if its contents don't match the hash.
+func (service *GalleryService) checkBlobFile(hash string) (int64, error) {
+	f, err := service.storage().Get(blobKey(hash))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return 0, fmt.Errorf("the contents of the file don't match its hash, restore it from a backup")
+	}
+	return size, nil
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRenderCacheSize is the size of RenderCache when MaxBytes is not
+	// set.
+	DefaultRenderCacheSize = 1 << 30
+)
+
+// RenderCache keeps rendered images as files on local disk. When the files
+// grow past MaxBytes, the least recently used ones are deleted. Unlike image
+// variants, renders can always be made again, so they are never stored with
+// the images.
+type RenderCache struct {
+	// The directory where renders are kept.
+	Dir string
+	// MaxBytes is the total size of the renders to keep. Defaults to
+	// DefaultRenderCacheSize.
+	MaxBytes int64
+
+	mu      sync.Mutex
+	loaded  bool
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type renderCacheEntry struct {
+	key  string
+	size int64
+}
+
+// Open returns the render stored under key, rendering it first with render
+// if it isn't in the cache. Callers must close the file.
+func (cache *RenderCache) Open(key string, render func(w io.Writer) error) (*os.File, error) {
+	err := cache.load()
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	p, err := cache.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+
+	f, err := os.Open(p)
+	if err == nil {
+		cache.touch(key)
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+
+	// Render to a temporary file first so readers never see a partial
+	// render. Two requests for the same render may both do the work, and the
+	// last one wins.
+	tmp, err := os.CreateTemp(cache.Dir, ".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	err = render(tmp)
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	// Open before evicting, so the new render can't be deleted before it is
+	// served even if it is larger than the whole cache.
+	f, err = os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("render cache: %w", err)
+	}
+	cache.add(key, info.Size())
+	return f, nil
+}
+
+// load indexes the renders left on disk by a previous run, oldest first, so
+// the cache keeps its size across restarts.
+func (cache *RenderCache) load() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.loaded {
+		return nil
+	}
+	err := os.MkdirAll(cache.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	dirEntries, err := os.ReadDir(cache.Dir)
+	if err != nil {
+		return err
+	}
+	type file struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(dirEntry.Name(), ".tmp-") {
+			os.Remove(filepath.Join(cache.Dir, dirEntry.Name()))
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, file{dirEntry.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	cache.lru = list.New()
+	cache.entries = make(map[string]*list.Element)
+	for _, f := range files {
+		cache.entries[f.key] = cache.lru.PushFront(&renderCacheEntry{key: f.key, size: f.size})
+		cache.size += f.size
+	}
+	cache.loaded = true
+	cache.evict()
+	return nil
+}
+
+func (cache *RenderCache) touch(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		cache.lru.MoveToFront(elem)
+	}
+}
+
+func (cache *RenderCache) add(key string, size int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.entries[key]; ok {
+		entry := elem.Value.(*renderCacheEntry)
+		cache.size += size - entry.size
+		entry.size = size
+		cache.lru.MoveToFront(elem)
+	} else {
+		cache.entries[key] = cache.lru.PushFront(&renderCacheEntry{key: key, size: size})
+		cache.size += size
+	}
+	cache.evict()
+}
+
+// evict deletes the least recently used renders until the cache fits in
+// MaxBytes. Files still open for serving stay readable until closed. It must
+// be called with mu held.
+func (cache *RenderCache) evict() {
+	maxBytes := cache.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultRenderCacheSize
+	}
+	for cache.size > maxBytes && cache.lru.Len() > 0 {
+		elem := cache.lru.Back()
+		entry := elem.Value.(*renderCacheEntry)
+		err := os.Remove(filepath.Join(cache.Dir, entry.key))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Println(fmt.Errorf("render cache: %w", err))
+		}
+		cache.lru.Remove(elem)
+		delete(cache.entries, entry.key)
+		cache.size -= entry.size
+	}
+}
+
+// path maps a key to a file in the cache directory. Keys are file names.
+func (cache *RenderCache) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(cache.Dir, key), nil
+}
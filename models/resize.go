@@ -0,0 +1,69 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// ImageSize is a scaled down version of images that can be requested instead
+// of the original.
+type ImageSize struct {
+	Name string
+	// MaxDimension is the largest width or height of the image in pixels.
+	MaxDimension int
+}
+
+// ImageSizes lists the sizes images are offered in, largest first.
+var ImageSizes = []ImageSize{
+	{Name: "large", MaxDimension: 2048},
+	{Name: "small", MaxDimension: 1024},
+}
+
+// ImageSizeByName looks up one of the ImageSizes.
+func ImageSizeByName(name string) (ImageSize, bool) {
+	for _, size := range ImageSizes {
+		if size.Name == name {
+			return size, true
+		}
+	}
+	return ImageSize{}, false
+}
+
+// encodeResizedJPEG decodes the image read from src, scales it down so
+// neither side exceeds maxDimension, and writes it to dst as a JPEG. Images
+// that are already small enough are only converted.
+func encodeResizedJPEG(dst io.Writer, src io.Reader, maxDimension int) error {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+	img = flatten(img)
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > maxDimension || height > maxDimension {
+		if width >= height {
+			width, height = maxDimension, height*maxDimension/width
+		} else {
+			width, height = width*maxDimension/height, maxDimension
+		}
+		// Very long and thin images would otherwise lose a side entirely.
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+		img = scaled
+	}
+	err = jpeg.Encode(dst, img, &jpeg.Options{Quality: FallbackJPEGQuality})
+	if err != nil {
+		return fmt.Errorf("encoding jpeg: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultScrubInterval is how often every stored file is read back and
+	// checked against its checksum.
+	DefaultScrubInterval = 30 * 24 * time.Hour
+	// DefaultScrubRate is how many bytes per second the scrubber reads, so it
+	// doesn't get in the way of serving images.
+	DefaultScrubRate = 10 << 20 // 10mb
+)
+
+var (
+	// ErrChecksumMismatch is returned when a file meant to replace a stored
+	// one doesn't have the same contents.
+	ErrChecksumMismatch = errors.New("models: checksum mismatch")
+)
+
+// ScrubFailure is a stored file that didn't match its checksum, or couldn't
+// be read. Image files stay corrupted until they are uploaded again. Variants
+// are deleted to be generated again, which resolves their failures right
+// away.
+type ScrubFailure struct {
+	Key        string
+	Hash       string
+	Detail     string
+	DetectedAt time.Time
+}
+
+type ScrubReport struct {
+	// Checked counts the files read. It is 0 once every file has been
+	// verified within the interval.
+	Checked  int
+	Bytes    int64
+	Failures []ScrubFailure
+}
+
+// CorruptedImage is an image whose file failed verification.
+type CorruptedImage struct {
+	Image
+	GalleryTitle string
+	OwnerEmail   string
+	Detail       string
+	DetectedAt   time.Time
+}
+
+// scrubFile is a stored file due for verification.
+type scrubFile struct {
+	key      string
+	hash     string
+	checksum string
+	size     int64
+	variant  bool
+}
+
+// Scrub reads back up to batch stored files that haven't been verified for
+// interval, the least recently verified first, and checks them against their
+// checksums. Reads are limited to bytesPerSecond, or unlimited if it is 0.
+// Failures are recorded, and corrupted variants are deleted since they can
+// be generated again.
+func (service *GalleryService) Scrub(interval time.Duration, batch int, bytesPerSecond int64) (ScrubReport, error) {
+	var report ScrubReport
+	files, err := service.scrubDue(interval, batch)
+	if err != nil {
+		return report, fmt.Errorf("scrub: %w", err)
+	}
+	limit := &throttle{bytesPerSecond: bytesPerSecond, start: time.Now()}
+	for _, file := range files {
+		detail, n, err := service.verifyFile(file, limit)
+		if err != nil {
+			return report, fmt.Errorf("scrub: %w", err)
+		}
+		report.Checked++
+		report.Bytes += n
+		recorded, err := service.recordScrub(file, detail)
+		if err != nil {
+			return report, fmt.Errorf("scrub: %w", err)
+		}
+		if recorded && detail != "" {
+			report.Failures = append(report.Failures, ScrubFailure{
+				Key:        file.key,
+				Hash:       file.hash,
+				Detail:     detail,
+				DetectedAt: time.Now(),
+			})
+		}
+	}
+	return report, nil
+}
+
+// scrubDue returns the files that haven't been verified for interval. Blobs
+// no image refers to anymore are about to be collected, so they are left
+// out.
+func (service *GalleryService) scrubDue(interval time.Duration, batch int) ([]scrubFile, error) {
+	rows, err := service.DB.Query(`
+		SELECT key, hash, checksum, size, variant
+		FROM (
+			SELECT '' AS key, hash, hash AS checksum, size, false AS variant, verified_at
+			FROM blobs
+			WHERE ref_count > 0 AND (verified_at IS NULL OR verified_at < $1)
+			UNION ALL
+			SELECT key, hash, checksum, size, true, verified_at
+			FROM variants
+			WHERE verified_at IS NULL OR verified_at < $1
+		) due
+		ORDER BY verified_at NULLS FIRST
+		LIMIT $2;
+	`, time.Now().Add(-interval), batch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []scrubFile
+	for rows.Next() {
+		var file scrubFile
+		err := rows.Scan(&file.key, &file.hash, &file.checksum, &file.size, &file.variant)
+		if err != nil {
+			return nil, err
+		}
+		if !file.variant {
+			file.key = blobKey(file.hash)
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// verifyFile reads a stored file and returns what is wrong with it, if
+// anything, along with the number of bytes read. Files that can't be read
+// through are failures, while errors opening them mean the storage itself is
+// unavailable.
+func (service *GalleryService) verifyFile(file scrubFile, limit *throttle) (string, int64, error) {
+	f, err := service.storage().Get(file.key)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return "the file is missing", 0, nil
+		}
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, throttledReader{f, limit})
+	if err != nil {
+		return fmt.Sprintf("reading the file failed: %v", err), n, nil
+	}
+	if n != file.size {
+		return fmt.Sprintf("the file has %d bytes, %d expected", n, file.size), n, nil
+	}
+	if hex.EncodeToString(h.Sum(nil)) != file.checksum {
+		return "the checksum doesn't match", n, nil
+	}
+	return "", n, nil
+}
+
+// recordScrub records the outcome of verifying a file. It reports false if
+// the file was deleted meanwhile, in which case there's nothing to record.
+func (service *GalleryService) recordScrub(file scrubFile, detail string) (bool, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// Garbage collection deletes files while holding the lock of their blob.
+	exists, err := lockBlob(tx, file.hash)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	if file.variant {
+		result, err := tx.Exec(`
+			UPDATE variants
+			SET verified_at = now()
+			WHERE key = $1 AND checksum = $2;
+		`, file.key, file.checksum)
+		if err != nil {
+			return false, err
+		}
+		// The variant was stored again meanwhile.
+		if checkRowsAffected(result, "verify variant") != nil {
+			return false, nil
+		}
+	} else {
+		_, err = tx.Exec(`
+			UPDATE blobs
+			SET verified_at = now()
+			WHERE hash = $1;
+		`, file.hash)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch {
+	case detail == "":
+		err = resolveScrubFailures(tx, file.key)
+	case file.variant:
+		err = service.storage().Delete(file.key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		_, err = tx.Exec(`
+			DELETE FROM variants
+			WHERE key = $1;
+		`, file.key)
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO scrub_failures (key, hash, detail, resolved_at)
+			VALUES ($1, $2, $3, now());
+		`, file.key, file.hash, detail+", deleted to be generated again")
+	default:
+		_, err = tx.Exec(`
+			INSERT INTO scrub_failures (key, hash, detail)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (key) WHERE resolved_at IS NULL DO NOTHING;
+		`, file.key, file.hash, detail)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func resolveScrubFailures(tx *sql.Tx, key string) error {
+	_, err := tx.Exec(`
+		UPDATE scrub_failures
+		SET resolved_at = now()
+		WHERE key = $1 AND resolved_at IS NULL;
+	`, key)
+	return err
+}
+
+// recordVariant records the checksum of a variant that was just stored.
+func (service *GalleryService) recordVariant(key, hash string, contents []byte) error {
+	sum := sha256.Sum256(contents)
+	_, err := service.DB.Exec(`
+		INSERT INTO variants (key, hash, checksum, size)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key) DO UPDATE
+		SET checksum = excluded.checksum, size = excluded.size, created_at = now(), verified_at = NULL;
+	`, key, hash, hex.EncodeToString(sum[:]), len(contents))
+	return err
+}
+
+// RepairBlob stores contents again as the file of a blob, once they are
+// checked against its hash. This is how owners replace the files the
+// scrubber found corrupted. ErrChecksumMismatch is returned for contents
+// that aren't the same.
+func (service *GalleryService) RepairBlob(hash string, contents io.Reader) error {
+	tmp, err := os.CreateTemp("", "lenslocked-repair-*")
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), contents)
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return fmt.Errorf("repair blob: %w", ErrChecksumMismatch)
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	defer tx.Rollback()
+	exists, err := lockBlob(tx, hash)
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("repair blob: %w", ErrNotFound)
+	}
+	err = service.storage().Put(blobKey(hash), tmp)
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE blobs
+		SET size = $2, verified_at = now()
+		WHERE hash = $1;
+	`, hash, size)
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	err = resolveScrubFailures(tx, blobKey(hash))
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("repair blob: %w", err)
+	}
+	return nil
+}
+
+// Corrupted returns what is wrong with the images of a gallery whose files
+// failed verification, by image ID.
+func (service *GalleryService) Corrupted(galleryID int) (map[string]string, error) {
+	rows, err := service.DB.Query(`
+		SELECT i.public_id, f.detail
+		FROM images i
+		JOIN scrub_failures f ON f.hash = i.content_hash AND f.resolved_at IS NULL
+		WHERE i.gallery_id = $1 AND i.deleted_at IS NULL;
+	`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query corrupted images: %w", err)
+	}
+	defer rows.Close()
+	corrupted := make(map[string]string)
+	for rows.Next() {
+		var id, detail string
+		err := rows.Scan(&id, &detail)
+		if err != nil {
+			return nil, fmt.Errorf("query corrupted images: %w", err)
+		}
+		corrupted[id] = detail
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query corrupted images: %w", err)
+	}
+	return corrupted, nil
+}
+
+// CorruptedImages returns every image whose file failed verification, across
+// all users, most recently detected first.
+func (service *GalleryService) CorruptedImages() ([]CorruptedImage, error) {
+	rows, err := service.DB.Query(`
+		SELECT i.public_id, i.gallery_id, i.filename, i.content_hash, coalesce(g.title, ''), u.email,
+			f.detail, f.detected_at
+		FROM scrub_failures f
+		JOIN images i ON i.content_hash = f.hash
+		JOIN galleries g ON g.id = i.gallery_id
+		JOIN users u ON u.id = g.user_id
+		WHERE f.resolved_at IS NULL
+		ORDER BY f.detected_at DESC, i.gallery_id, i.filename;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("query corrupted images: %w", err)
+	}
+	defer rows.Close()
+	var images []CorruptedImage
+	for rows.Next() {
+		var image CorruptedImage
+		err := rows.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.ContentHash, &image.GalleryTitle,
+			&image.OwnerEmail, &image.Detail, &image.DetectedAt)
+		if err != nil {
+			return nil, fmt.Errorf("query corrupted images: %w", err)
+		}
+		image.Key = blobKey(image.ContentHash)
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query corrupted images: %w", err)
+	}
+	return images, nil
+}
+
+// throttle limits reads to a number of bytes per second, across every reader
+// using it.
+type throttle struct {
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+// wait sleeps until n more bytes can be read within the limit.
+func (t *throttle) wait(n int) {
+	if t.bytesPerSecond <= 0 {
+		return
+	}
+	t.read += int64(n)
+	due := time.Duration(float64(t.read) / float64(t.bytesPerSecond) * float64(time.Second))
+	if d := due - time.Since(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+type throttledReader struct {
+	r     io.Reader
+	limit *throttle
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.limit.wait(n)
+	return n, err
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const (
+	// HighlightStart and HighlightStop surround the matches in the Headline of
+	// search results. They are private use characters, which don't show up
+	// in real text.
+	HighlightStart = "\uE000"
+	HighlightStop  = "\uE001"
+
+	// DefaultSearchLimit is the number of results returned when no limit is
+	// given.
+	DefaultSearchLimit = 50
+)
+
+// SearchResult is a gallery or an image matching a search.
+type SearchResult struct {
+	GalleryID    int
+	GalleryTitle string
+	// Image is nil when the gallery itself matched.
+	Image *Image
+	// Headline is an excerpt of the text that matched, with the matching
+	// words between HighlightStart and HighlightStop.
+	Headline string
+	Rank     float64
+}
+
+// Search finds the galleries and images of a user that match a query. The
+// query is written like for a web search engine: words, "quoted phrases", or
+// and -excluded words. Titles weigh the most, then tags, then captions and
+// last filenames.
+func (service *GalleryService) Search(userID int, query string, limit int) ([]SearchResult, error) {
+	return service.search(query, limit, "g.user_id = $3", userID)
+}
+
+// SearchPublic is like Search over all public galleries.
+func (service *GalleryService) SearchPublic(query string, limit int) ([]SearchResult, error) {
+	return service.search(query, limit, "g.visibility = $3", VisibilityPublic)
+}
+
+// search runs a query over the galleries matching the condition where, which
+// may refer to its argument as $3.
+func (service *GalleryService) search(query string, limit int, where string, arg interface{}) ([]SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	headlineOptions := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxFragments=2", HighlightStart, HighlightStop)
+
+	// Words are matched both stemmed, for titles and captions, and as
+	// written, for tags and filenames.
+	rows, err := service.DB.Query(fmt.Sprintf(`
+		WITH q AS (
+			SELECT websearch_to_tsquery('english', $1) || websearch_to_tsquery('simple', $1) AS query
+		)
+		SELECT g.id, coalesce(g.title, ''),
+			NULL::TEXT, NULL::TEXT, NULL::TEXT, NULL::TEXT, NULL::TEXT[],
+			ts_headline('english', concat_ws(' ', g.title, tags_to_text(g.tags)), q.query, $4),
+			ts_rank(g.search, q.query) AS rank
+		FROM galleries g, q
+		WHERE g.search @@ q.query AND g.deleted_at IS NULL AND %[1]s
+		UNION ALL
+		SELECT g.id, coalesce(g.title, ''),
+			i.public_id, i.filename, i.content_hash, i.caption, i.tags,
+			ts_headline('english', concat_ws(' ', nullif(i.caption, ''), tags_to_text(i.tags), i.filename), q.query, $4),
+			ts_rank(i.search, q.query) AS rank
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id, q
+		WHERE i.search @@ q.query AND i.deleted_at IS NULL AND g.deleted_at IS NULL AND %[1]s
+		ORDER BY rank DESC
+		LIMIT $2;
+	`, where), query, limit, arg, headlineOptions)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	defer rows.Close()
+
+	m := pgtype.NewMap()
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var id, filename, contentHash, caption sql.NullString
+		var tags []string
+		err := rows.Scan(&result.GalleryID, &result.GalleryTitle,
+			&id, &filename, &contentHash, &caption, m.SQLScanner(&tags),
+			&result.Headline, &result.Rank)
+		if err != nil {
+			return nil, fmt.Errorf("search: %w", err)
+		}
+		if id.Valid {
+			result.Image = &Image{
+				ID:          id.String,
+				GalleryID:   result.GalleryID,
+				Key:         blobKey(contentHash.String),
+				Filename:    filename.String,
+				ContentHash: contentHash.String,
+				Caption:     caption.String,
+				Tags:        tags,
+			}
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	return results, nil
+}
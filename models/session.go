@@ -94,7 +94,8 @@ func (ss *SessionService) User(token string) (*User, error) {
 		SELECT
 			u.id,
 			u.email,
-			u.password_hash
+			u.password_hash,
+			u.admin
 		FROM
 			sessions s
 		JOIN users u ON
@@ -102,7 +103,7 @@ func (ss *SessionService) User(token string) (*User, error) {
 		WHERE
 			s.token_hash = $1;
 	`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Admin)
 	if err != nil {
 		return nil, fmt.Errorf("user: %w", err)
 	}
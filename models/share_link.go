@@ -0,0 +1,272 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"archazid.io/lenslocked/rand"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrWrongPassword = errors.New("models: wrong password")
+	// ErrShareLinkLocked is returned for share links that need a password
+	// when it hasn't been entered.
+	ErrShareLinkLocked = errors.New("models: share link needs a password")
+)
+
+// ShareLink gives anyone holding its token access to a gallery, whatever the
+// gallery's visibility.
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	// Label helps the owner tell links apart, like "Client" or "Family".
+	Label string
+	// Token is only set when a ShareLink is being created.
+	Token          string
+	TokenHash      string
+	AllowDownloads bool
+	CreatedAt      time.Time
+	// ExpiresAt is zero for links that never expire.
+	ExpiresAt time.Time
+	// PasswordHash is set for links that ask for a password before giving
+	// access to the gallery.
+	PasswordHash string
+	// MaxFavorites limits how many images the client may pick as favorites.
+	// Zero means no limit.
+	MaxFavorites int
+	// SubmittedAt is set once the client has submitted their selection,
+	// which can't be changed afterwards.
+	SubmittedAt time.Time
+}
+
+// Expired reports whether the link can no longer be used.
+func (link ShareLink) Expired() bool {
+	return !link.ExpiresAt.IsZero() && time.Now().After(link.ExpiresAt)
+}
+
+// Submitted reports whether the client has submitted their selection.
+func (link ShareLink) Submitted() bool {
+	return !link.SubmittedAt.IsZero()
+}
+
+type ShareLinkService struct {
+	DB *sql.DB
+	// Bytes to use when generating each share link token.
+	// If this value is not set or less than const MinBytesPerToken then it wil be ignored.
+	BytesPerToken int
+}
+
+// Create adds a share link to the gallery of link, using its label,
+// AllowDownloads and MaxFavorites, and sets its Token. A zero duration
+// creates a link that never expires, and an empty password one that doesn't
+// ask for a password.
+func (service *ShareLinkService) Create(link *ShareLink, password string, duration time.Duration) error {
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinBytesPerToken {
+		bytesPerToken = MinBytesPerToken
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return fmt.Errorf("create share link: %w", err)
+	}
+	link.Token = token
+	link.TokenHash = service.hash(token)
+	if link.MaxFavorites < 0 {
+		link.MaxFavorites = 0
+	}
+	var passwordHash sql.NullString
+	if password != "" {
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("create share link: %w", err)
+		}
+		link.PasswordHash = string(hashedBytes)
+		passwordHash = sql.NullString{String: link.PasswordHash, Valid: true}
+	}
+	var expiresAt sql.NullTime
+	if duration > 0 {
+		link.ExpiresAt = time.Now().Add(duration)
+		expiresAt = sql.NullTime{Time: link.ExpiresAt, Valid: true}
+	}
+
+	row := service.DB.QueryRow(`
+		INSERT INTO share_links (gallery_id, token_hash, label, allow_downloads, expires_at,
+			password_hash, max_favorites)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at;
+	`, link.GalleryID, link.TokenHash, link.Label, link.AllowDownloads, expiresAt,
+		passwordHash, link.MaxFavorites)
+	err = row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("create share link: %w", err)
+	}
+	return nil
+}
+
+// ByToken looks up the share link for a token. Expired links are reported as
+// ErrNotFound.
+func (service *ShareLinkService) ByToken(token string) (*ShareLink, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+shareLinkColumns+`
+		FROM share_links
+		WHERE token_hash = $1;
+	`, service.hash(token))
+	if err != nil {
+		return nil, fmt.Errorf("query share link by token: %w", err)
+	}
+	links, err := scanShareLinks(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query share link by token: %w", err)
+	}
+	if len(links) == 0 || links[0].Expired() {
+		return nil, ErrNotFound
+	}
+	return &links[0], nil
+}
+
+// ByAccessKey looks up the share link for a key made by AccessKey. Links that
+// ask for a password are only found if the key shows it was entered, and
+// otherwise ErrShareLinkLocked is returned.
+func (service *ShareLinkService) ByAccessKey(key string) (*ShareLink, error) {
+	token, proof, _ := strings.Cut(key, ".")
+	link, err := service.ByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if link.PasswordHash != "" && !hmac.Equal([]byte(proof), []byte(passwordProof(link, token))) {
+		return nil, ErrShareLinkLocked
+	}
+	return link, nil
+}
+
+// ByID returns a share link of a gallery, expired or not.
+func (service *ShareLinkService) ByID(galleryID, id int) (*ShareLink, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+shareLinkColumns+`
+		FROM share_links
+		WHERE gallery_id = $1 AND id = $2;
+	`, galleryID, id)
+	if err != nil {
+		return nil, fmt.Errorf("query share link by id: %w", err)
+	}
+	links, err := scanShareLinks(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query share link by id: %w", err)
+	}
+	if len(links) == 0 {
+		return nil, ErrNotFound
+	}
+	return &links[0], nil
+}
+
+// Unlock checks the password of a share link opened with token, and returns
+// the key to look the link up with from then on. ip is the address of the
+// visitor. Once passwords for the link or from the address have been wrong
+// too often, a ThrottleError is returned without checking the password.
+func (service *ShareLinkService) Unlock(link *ShareLink, token, password, ip string) (string, error) {
+	if link.PasswordHash != "" {
+		attempt, err := service.startUnlockAttempt(link, ip)
+		if err != nil {
+			return "", fmt.Errorf("unlock: %w", err)
+		}
+		err = bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password))
+		if err != nil {
+			return "", ErrWrongPassword
+		}
+		err = service.forgetUnlockAttempt(attempt)
+		if err != nil {
+			return "", fmt.Errorf("unlock: %w", err)
+		}
+	}
+	return service.AccessKey(link, token), nil
+}
+
+// AccessKey returns the key visitors keep to use a share link. For links
+// with a password, it proves the password was entered without storing it.
+// Callers must check the password first.
+func (service *ShareLinkService) AccessKey(link *ShareLink, token string) string {
+	if link.PasswordHash == "" {
+		return token
+	}
+	return token + "." + passwordProof(link, token)
+}
+
+// passwordProof is derived from the password hash, which visitors never see,
+// so it can't be made up by someone who only has the token. Changing the
+// password would invalidate it.
+func passwordProof(link *ShareLink, token string) string {
+	mac := hmac.New(sha256.New, []byte(link.PasswordHash))
+	mac.Write([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ByGalleryID returns the share links of a gallery, newest first. Expired
+// links are included so the owner can see and remove them.
+func (service *ShareLinkService) ByGalleryID(galleryID int) ([]ShareLink, error) {
+	rows, err := service.DB.Query(`
+		SELECT `+shareLinkColumns+`
+		FROM share_links
+		WHERE gallery_id = $1
+		ORDER BY created_at DESC;
+	`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("query share links by gallery: %w", err)
+	}
+	links, err := scanShareLinks(rows)
+	if err != nil {
+		return nil, fmt.Errorf("query share links by gallery: %w", err)
+	}
+	return links, nil
+}
+
+// Delete revokes a share link of a gallery.
+func (service *ShareLinkService) Delete(galleryID, id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM share_links
+		WHERE gallery_id = $1 AND id = $2;
+	`, galleryID, id)
+	if err != nil {
+		return fmt.Errorf("delete share link: %w", err)
+	}
+	return nil
+}
+
+func (service *ShareLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// shareLinkColumns are the columns read by scanShareLinks.
+const shareLinkColumns = `id, gallery_id, label, token_hash, allow_downloads, created_at, expires_at,
+	password_hash, max_favorites, submitted_at`
+
+// scanShareLinks reads and closes rows of shareLinkColumns.
+func scanShareLinks(rows *sql.Rows) ([]ShareLink, error) {
+	defer rows.Close()
+	var links []ShareLink
+	for rows.Next() {
+		var link ShareLink
+		var expiresAt, submittedAt sql.NullTime
+		var passwordHash sql.NullString
+		err := rows.Scan(&link.ID, &link.GalleryID, &link.Label, &link.TokenHash, &link.AllowDownloads,
+			&link.CreatedAt, &expiresAt, &passwordHash, &link.MaxFavorites, &submittedAt)
+		if err != nil {
+			return nil, err
+		}
+		link.ExpiresAt = expiresAt.Time
+		link.PasswordHash = passwordHash.String
+		link.SubmittedAt = submittedAt.Time
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// UnlockFailureWindow is how long a wrong share link password counts
+	// toward throttling.
+	UnlockFailureWindow = time.Hour
+	// Wrong passwords allowed from one IP address, and for one share link
+	// from anywhere, before each attempt has to wait. Links allow more, as
+	// guests may share an address behind a proxy but an attacker shouldn't
+	// be able to lock everyone out of a link quickly.
+	freeUnlockFailuresPerIP   = 5
+	freeUnlockFailuresPerLink = 20
+	// The wait doubles with each wrong password past the free ones, up to
+	// maxUnlockDelay.
+	baseUnlockDelay = 2 * time.Second
+	maxUnlockDelay  = 15 * time.Minute
+)
+
+// ThrottleError is returned for share link passwords tried too often. No
+// password is checked until RetryAfter has passed.
+type ThrottleError struct {
+	RetryAfter time.Duration
+}
+
+func (te ThrottleError) Error() string {
+	return fmt.Sprintf("too many wrong passwords, retry after %v", te.RetryAfter)
+}
+
+// startUnlockAttempt records an attempt at the password of a link as a wrong
+// password, before the password is checked, and returns its ID. Only once
+// the password turns out right is the attempt forgotten with
+// forgetUnlockAttempt. Attempts sent at the same time are counted one after
+// the other, so a burst of guesses is throttled like guesses sent in a row.
+// A ThrottleError is returned, and nothing recorded, if the password of the
+// link, or passwords from the IP address, were wrong too often recently.
+func (service *ShareLinkService) startUnlockAttempt(link *ShareLink, ip string) (int, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("start unlock attempt: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The link is always locked before the address, so attempts can't wait
+	// on each other in a cycle.
+	_, err = tx.Exec(`
+		SELECT id
+		FROM share_links
+		WHERE id = $1
+		FOR UPDATE;
+	`, link.ID)
+	if err != nil {
+		return 0, fmt.Errorf("start unlock attempt: %w", err)
+	}
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('share_link_failures:' || $1));`, ip)
+	if err != nil {
+		return 0, fmt.Errorf("start unlock attempt: %w", err)
+	}
+	err = checkUnlockThrottle(tx, link, ip)
+	if err != nil {
+		return 0, fmt.Errorf("start unlock attempt: %w", err)
+	}
+
+	var id int
+	row := tx.QueryRow(`
+		INSERT INTO share_link_failures (share_link_id, ip, failed_at)
+		VALUES ($1, $2, $3)
+		RETURNING id;
+	`, link.ID, ip, time.Now())
+	err = row.Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("start unlock attempt: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("start unlock attempt: %w", err)
+	}
+	return id, nil
+}
+
+// forgetUnlockAttempt removes an attempt recorded by startUnlockAttempt,
+// once its password turned out right.
+func (service *ShareLinkService) forgetUnlockAttempt(id int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM share_link_failures
+		WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("forget unlock attempt: %w", err)
+	}
+	return nil
+}
+
+// checkUnlockThrottle returns a ThrottleError if the password of the link, or
+// passwords from the IP address, were wrong too often recently.
+func checkUnlockThrottle(tx *sql.Tx, link *ShareLink, ip string) error {
+	now := time.Now()
+	row := tx.QueryRow(`
+		SELECT count(*) FILTER (WHERE share_link_id = $1), max(failed_at) FILTER (WHERE share_link_id = $1),
+			count(*) FILTER (WHERE ip = $2), max(failed_at) FILTER (WHERE ip = $2)
+		FROM share_link_failures
+		WHERE (share_link_id = $1 OR ip = $2) AND failed_at > $3;
+	`, link.ID, ip, now.Add(-UnlockFailureWindow))
+	var linkFailures, ipFailures int
+	var linkLast, ipLast sql.NullTime
+	err := row.Scan(&linkFailures, &linkLast, &ipFailures, &ipLast)
+	if err != nil {
+		return fmt.Errorf("check unlock throttle: %w", err)
+	}
+	var wait time.Duration
+	if linkLast.Valid {
+		wait = unlockDelay(linkFailures-freeUnlockFailuresPerLink) - now.Sub(linkLast.Time)
+	}
+	if ipLast.Valid {
+		if ipWait := unlockDelay(ipFailures-freeUnlockFailuresPerIP) - now.Sub(ipLast.Time); ipWait > wait {
+			wait = ipWait
+		}
+	}
+	if wait > 0 {
+		return ThrottleError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// unlockDelay is how long to wait after the last wrong password, given the
+// number of wrong passwords past the free ones.
+func unlockDelay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := baseUnlockDelay
+	for i := 1; i < failures && delay < maxUnlockDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxUnlockDelay {
+		delay = maxUnlockDelay
+	}
+	return delay
+}
+
+// DeleteOldUnlockFailures forgets wrong passwords that no longer count toward
+// throttling.
+func (service *ShareLinkService) DeleteOldUnlockFailures() error {
+	_, err := service.DB.Exec(`
+		DELETE FROM share_link_failures
+		WHERE failed_at < $1;
+	`, time.Now().Add(-UnlockFailureWindow))
+	if err != nil {
+		return fmt.Errorf("delete old unlock failures: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrPresignNotSupported = errors.New("models: storage does not support presigned urls")
+)
+
+// Storage is where image files are kept. Keys are slash separated paths
+// relative to the root of the storage, like "gallery-1/photo.jpg". Methods
+// return ErrNotFound when the key does not exist.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object.
+	Put(key string, r io.Reader) error
+	// Get opens the object stored under key. Callers must close it.
+	Get(key string) (io.ReadSeekCloser, error)
+	Stat(key string) (StorageObject, error)
+	Delete(key string) error
+	// List returns every object whose key starts with prefix, sorted by key.
+	List(prefix string) ([]StorageObject, error)
+	// Presign returns a URL that gives anyone holding it read access to the
+	// object for the given duration.
+	Presign(key string, expires time.Duration) (string, error)
+}
+
+type StorageObject struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+type StorageConfig struct {
+	// Backend is either "local" or "s3". Defaults to "local".
+	Backend string
+	// Dir is the root directory of the local backend.
+	Dir string
+	S3  S3Config
+}
+
+func NewStorage(config StorageConfig) (Storage, error) {
+	switch config.Backend {
+	case "", "local":
+		return &LocalStorage{Dir: config.Dir}, nil
+	case "s3":
+		return NewS3Storage(config.S3), nil
+	}
+	return nil, fmt.Errorf("new storage: unknown backend %q", config.Backend)
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LocalStorage keeps objects as files under a directory on local disk.
+type LocalStorage struct {
+	// The directory where objects are stored. Defaults to "images".
+	Dir string
+}
+
+func (ls *LocalStorage) Put(key string, r io.Reader) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	// Write to a temporary file first so readers never see a partial object.
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	return nil
+}
+
+func (ls *LocalStorage) Get(key string) (io.ReadSeekCloser, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	return f, nil
+}
+
+func (ls *LocalStorage) Stat(key string) (StorageObject, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return StorageObject{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return StorageObject{}, ErrNotFound
+		}
+		return StorageObject{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	if info.IsDir() {
+		return StorageObject{}, ErrNotFound
+	}
+	return StorageObject{
+		Key:     key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (ls *LocalStorage) Delete(key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	err = os.Remove(p)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	// Clean up directories left empty, so deleting every image of a gallery
+	// doesn't leave an empty gallery directory behind. Removing a directory
+	// that still has files fails, which is what stops the loop.
+	root := filepath.Clean(ls.dir())
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (ls *LocalStorage) List(prefix string) ([]StorageObject, error) {
+	// Only walk the deepest directory that can contain matching keys.
+	walkDir := "."
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkDir = prefix[:i]
+	}
+	if walkDir != "." && !fs.ValidPath(walkDir) {
+		return nil, fmt.Errorf("list %v: invalid prefix", prefix)
+	}
+
+	var objects []StorageObject
+	root := filepath.Join(ls.dir(), filepath.FromSlash(walkDir))
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(ls.dir(), p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, StorageObject{
+			Key:     key,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list %v: %w", prefix, err)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// Presign is not supported by local storage, since files on disk are only
+// reachable through the application.
+func (ls *LocalStorage) Presign(key string, expires time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
+
+func (ls *LocalStorage) dir() string {
+	if ls.Dir == "" {
+		return "images"
+	}
+	return ls.Dir
+}
+
+// path maps a key to a file path, rejecting keys that would point outside of
+// the storage directory.
+func (ls *LocalStorage) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("invalid key")
+	}
+	return filepath.Join(ls.dir(), filepath.FromSlash(path.Clean(key))), nil
+}
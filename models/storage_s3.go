@@ -0,0 +1,464 @@
+package models
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Presigned URLs can be valid for at most 7 days.
+	MaxPresignDuration = 7 * 24 * time.Hour
+)
+
+type S3Config struct {
+	// Endpoint is the base URL of the S3 compatible service, for example
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+	Region   string
+	// Bucket is empty when the endpoint already addresses the bucket, as with
+	// virtual-hosted style URLs like "https://bucket.s3.amazonaws.com".
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3Storage keeps objects in a bucket of an S3 compatible service. Requests
+// are signed with AWS Signature Version 4 and use path style addressing, which
+// every S3 compatible service supports.
+type S3Storage struct {
+	config S3Config
+	client *http.Client
+	// now is used when signing requests. Replace it to get deterministic
+	// signatures.
+	now func() time.Time
+}
+
+func NewS3Storage(config S3Config) *S3Storage {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &S3Storage{
+		config: config,
+		client: http.DefaultClient,
+		now:    time.Now,
+	}
+}
+
+func (s3 *S3Storage) Put(key string, r io.Reader) error {
+	// S3 needs to know the size of an object up front.
+	body, size, cleanup, err := sizedReader(r)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	defer cleanup()
+
+	// The transport closes request bodies, but the reader belongs to the
+	// caller who may still want to use it.
+	req, err := http.NewRequest(http.MethodPut, s3.objectURL(key), io.NopCloser(body))
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		return fmt.Errorf("put %v: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s3 *S3Storage) Get(key string) (io.ReadSeekCloser, error) {
+	obj, err := s3.Stat(key)
+	if err != nil {
+		return nil, fmt.Errorf("get %v: %w", key, err)
+	}
+	return &s3Object{storage: s3, key: key, size: obj.Size}, nil
+}
+
+func (s3 *S3Storage) Stat(key string) (StorageObject, error) {
+	req, err := http.NewRequest(http.MethodHead, s3.objectURL(key), nil)
+	if err != nil {
+		return StorageObject{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		return StorageObject{}, fmt.Errorf("stat %v: %w", key, err)
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StorageObject{
+		Key:     key,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+func (s3 *S3Storage) Delete(key string) error {
+	// S3 reports success when deleting a missing key, but callers expect
+	// ErrNotFound like with the other backends.
+	_, err := s3.Stat(key)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	req, err := http.NewRequest(http.MethodDelete, s3.objectURL(key), nil)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	resp, err := s3.do(req)
+	if err != nil {
+		return fmt.Errorf("delete %v: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s3 *S3Storage) List(prefix string) ([]StorageObject, error) {
+	var objects []StorageObject
+	continuationToken := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, s3.bucketURL()+"?"+encodeQuery(query), nil)
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+		resp, err := s3.do(req)
+		if err != nil {
+			return nil, fmt.Errorf("list %v: %w", prefix, err)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %v: decoding response: %w", prefix, err)
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, StorageObject{
+				Key:     c.Key,
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (s3 *S3Storage) Presign(key string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > MaxPresignDuration {
+		return "", fmt.Errorf("presign %v: invalid duration %v", key, expires)
+	}
+	u, err := url.Parse(s3.objectURL(key))
+	if err != nil {
+		return "", fmt.Errorf("presign %v: %w", key, err)
+	}
+	now := s3.now().UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s3.config.AccessKeyID + "/" + s3.scope(now)},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonical := canonicalRequest(http.MethodGet, u.EscapedPath(), query, nil, u.Host, []string{"host"},
+		"UNSIGNED-PAYLOAD")
+	query.Set("X-Amz-Signature", s3.signature(now, canonical))
+	u.RawQuery = encodeQuery(query)
+	return u.String(), nil
+}
+
+func (s3 *S3Storage) bucketURL() string {
+	if s3.config.Bucket == "" {
+		return s3.config.Endpoint
+	}
+	return s3.config.Endpoint + "/" + s3.config.Bucket
+}
+
+func (s3 *S3Storage) objectURL(key string) string {
+	return s3.bucketURL() + "/" + escapePath(key)
+}
+
+// do signs and sends a request. Responses with a status code outside of 2xx
+// are turned into errors, with 404 mapped to ErrNotFound.
+func (s3 *S3Storage) do(req *http.Request) (*http.Response, error) {
+	s3.sign(req)
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("s3: %v: %s", resp.Status, bytes.TrimSpace(msg))
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request.
+// The payload is not part of the signature, so bodies can be streamed.
+func (s3 *S3Storage) sign(req *http.Request) {
+	now := s3.now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signedHeaders = append(signedHeaders, "range")
+	}
+	canonical := canonicalRequest(req.Method, req.URL.EscapedPath(), req.URL.Query(), req.Header, req.URL.Host,
+		signedHeaders, "UNSIGNED-PAYLOAD")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.config.AccessKeyID, s3.scope(now), strings.Join(signedHeaders, ";"),
+		s3.signature(now, canonical)))
+}
+
+func (s3 *S3Storage) scope(t time.Time) string {
+	return credentialScope(t, s3.config.Region, "s3")
+}
+
+func (s3 *S3Storage) signature(t time.Time, canonicalRequest string) string {
+	return signV4(s3.config.SecretAccessKey, s3.config.Region, "s3", t, canonicalRequest)
+}
+
+// canonicalRequest returns the canonical form of a request, which is what
+// Signature Version 4 signs. path must be escaped with escapePath, and is "/"
+// when empty. The host header is taken from host rather than header, as Go
+// keeps it out of http.Header.
+func canonicalRequest(method, path string, query url.Values, header http.Header, host string,
+	signedHeaders []string, payloadHash string) string {
+	if path == "" {
+		path = "/"
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		value := header.Get(h)
+		if h == "host" {
+			value = host
+		}
+		// Sequential spaces in values are collapsed to one.
+		value = strings.Join(strings.Fields(value), " ")
+		canonicalHeaders.WriteString(h + ":" + value + "\n")
+	}
+	return strings.Join([]string{
+		method,
+		path,
+		encodeQuery(query),
+		canonicalHeaders.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func credentialScope(t time.Time, region, service string) string {
+	return t.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+// signV4 returns the Signature Version 4 signature of a canonical request
+// made at t.
+func signV4(secretAccessKey, region, service string, t time.Time, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		credentialScope(t, region, service),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent-encodes every byte of a key except unreserved
+// characters and slashes, as required for canonical S3 requests.
+func escapePath(key string) string {
+	var sb strings.Builder
+	for _, b := range []byte(key) {
+		if b == '/' || isUnreserved(b) {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+// encodeQuery encodes query parameters sorted by key and then by value, using
+// the same percent-encoding rules as escapePath except that slashes are
+// encoded too. Sorting happens after encoding, as the canonical query string
+// requires.
+func encodeQuery(query url.Values) string {
+	type param struct{ key, value string }
+	var params []param
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, param{
+				key:   strings.ReplaceAll(escapePath(k), "/", "%2F"),
+				value: strings.ReplaceAll(escapePath(v), "/", "%2F"),
+			})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].key != params[j].key {
+			return params[i].key < params[j].key
+		}
+		return params[i].value < params[j].value
+	})
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.key + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+func isUnreserved(b byte) bool {
+	return 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+		b == '-' || b == '_' || b == '.' || b == '~'
+}
+
+// sizedReader returns a reader along with its size. Readers that can seek are
+// measured in place, anything else is spooled to a temporary file. cleanup
+// must be called once the reader is no longer needed.
+func sizedReader(r io.Reader) (io.Reader, int64, func(), error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := rs.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			_, err = rs.Seek(start, io.SeekStart)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			return rs, end - start, func() {}, nil
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "lenslocked-upload-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return tmp, size, cleanup, nil
+}
+
+// s3Object reads an object lazily with ranged GET requests, so seeking (as
+// http.ServeContent does to answer range requests) doesn't download anything.
+type s3Object struct {
+	storage *S3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := http.NewRequest(http.MethodGet, o.storage.objectURL(o.key), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		resp, err := o.storage.do(req)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, fmt.Errorf("seek: invalid whence")
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("seek: negative position")
+	}
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+	return abs, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	// MaxTags is the number of tags a gallery or image can have.
+	MaxTags = 20
+	// MaxTagLength is the length of a tag in characters.
+	MaxTagLength = 40
+	// MaxCaptionLength is the length of an image caption in characters.
+	MaxCaptionLength = 2000
+)
+
+// ParseTags splits a comma separated list of tags, like "wedding, Smith
+// Family". Tags are lowercased, surrounding and repeated spaces are dropped,
+// and duplicates are removed. Tags past MaxTags are ignored and long tags are
+// cut to MaxTagLength.
+func ParseTags(s string) []string {
+	tags := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.Join(strings.FieldsFunc(strings.ToLower(tag), func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r)
+		}), " ")
+		tag = truncateRunes(tag, MaxTagLength)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == MaxTags {
+			break
+		}
+	}
+	return tags
+}
+
+// truncateRunes cuts s to at most n characters.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:n]))
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"archazid.io/lenslocked/rand"
+)
+
+const (
+	// DefaultTransferDuration is how long the recipient of a gallery has to
+	// accept it.
+	DefaultTransferDuration = 7 * 24 * time.Hour
+)
+
+var (
+	ErrTransferToSelf = errors.New("models: gallery transfer to its owner")
+)
+
+// Transfer is a request to hand a gallery over to another user, who accepts
+// it with the emailed token while signed in with the address it was sent to.
+type Transfer struct {
+	ID         int
+	GalleryID  int
+	FromUserID int
+	// ToEmail is the address the transfer was sent to. It doesn't need to
+	// have an account yet, so that requesting a transfer doesn't tell which
+	// addresses have one.
+	ToEmail string
+	// Token is only set when a Transfer is being created.
+	Token     string
+	ExpiresAt time.Time
+
+	// GalleryTitle and FromEmail describe the transfer to the users.
+	GalleryTitle string
+	FromEmail    string
+}
+
+// RequestTransfer asks to hand a gallery over to whoever signs in with the
+// given email address. It replaces any pending transfer of the gallery.
+func (service *GalleryService) RequestTransfer(galleryID int, toEmail string) (*Transfer, error) {
+	transfer := Transfer{
+		GalleryID: galleryID,
+		ToEmail:   strings.ToLower(strings.TrimSpace(toEmail)),
+		ExpiresAt: time.Now().Add(DefaultTransferDuration),
+	}
+	row := service.DB.QueryRow(`
+		SELECT g.user_id, coalesce(g.title, ''), u.email
+		FROM galleries g
+		JOIN users u ON u.id = g.user_id
+		WHERE g.id = $1 AND g.deleted_at IS NULL;
+	`, galleryID)
+	err := row.Scan(&transfer.FromUserID, &transfer.GalleryTitle, &transfer.FromEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("request transfer: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("request transfer: %w", err)
+	}
+	if transfer.ToEmail == transfer.FromEmail {
+		return nil, fmt.Errorf("request transfer: %w", ErrTransferToSelf)
+	}
+
+	transfer.Token, err = rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("request transfer: %w", err)
+	}
+	row = service.DB.QueryRow(`
+		INSERT INTO gallery_transfers (gallery_id, from_user_id, to_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (gallery_id) DO UPDATE
+		SET from_user_id = excluded.from_user_id, to_email = excluded.to_email,
+			token_hash = excluded.token_hash, created_at = now(), expires_at = excluded.expires_at
+		RETURNING id;
+	`, transfer.GalleryID, transfer.FromUserID, transfer.ToEmail, hashTransferToken(transfer.Token),
+		transfer.ExpiresAt)
+	err = row.Scan(&transfer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("request transfer: %w", err)
+	}
+	return &transfer, nil
+}
+
+// PendingTransfer returns the transfer of a gallery waiting to be accepted,
+// or ErrNotFound.
+func (service *GalleryService) PendingTransfer(galleryID int) (*Transfer, error) {
+	transfer, err := service.queryTransfer(`t.gallery_id = $1`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("pending transfer: %w", err)
+	}
+	return transfer, nil
+}
+
+// TransferByToken returns the transfer a recipient was sent the token of, or
+// ErrNotFound if it expired or was canceled.
+func (service *GalleryService) TransferByToken(token string) (*Transfer, error) {
+	transfer, err := service.queryTransfer(`t.token_hash = $1`, hashTransferToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("transfer by token: %w", err)
+	}
+	return transfer, nil
+}
+
+func (service *GalleryService) queryTransfer(where string, arg interface{}) (*Transfer, error) {
+	var transfer Transfer
+	row := service.DB.QueryRow(`
+		SELECT t.id, t.gallery_id, t.from_user_id, t.to_email, t.expires_at, coalesce(g.title, ''),
+			f.email
+		FROM gallery_transfers t
+		JOIN galleries g ON g.id = t.gallery_id
+		JOIN users f ON f.id = t.from_user_id
+		WHERE `+where+` AND t.expires_at > now() AND g.user_id = t.from_user_id AND g.deleted_at IS NULL;
+	`, arg)
+	err := row.Scan(&transfer.ID, &transfer.GalleryID, &transfer.FromUserID, &transfer.ToEmail,
+		&transfer.ExpiresAt, &transfer.GalleryTitle, &transfer.FromEmail)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &transfer, nil
+}
+
+// CancelTransfer withdraws the pending transfer of a gallery.
+func (service *GalleryService) CancelTransfer(galleryID int) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM gallery_transfers
+		WHERE gallery_id = $1;
+	`, galleryID)
+	if err != nil {
+		return fmt.Errorf("cancel transfer: %w", err)
+	}
+	return nil
+}
+
+// AcceptTransfer hands the gallery of a transfer over to its recipient, the
+// user with the given ID, who has to have the address it was sent to. The gallery keeps its images, share
+// links and comments, and its storage counts toward the quota of the new
+// owner from then on. It leaves the collections of the previous owner, and
+// is watermarked with the watermark of the new owner. A QuotaError is
+// returned if the gallery doesn't fit in the quota of the recipient.
+func (service *GalleryService) AcceptTransfer(token string, userID int) (*Gallery, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	defer tx.Rollback()
+
+	var transfer Transfer
+	var email string
+	row := tx.QueryRow(`
+		SELECT t.id, t.gallery_id, t.from_user_id, t.to_email, u.email
+		FROM gallery_transfers t
+		JOIN users u ON u.id = $2
+		WHERE t.token_hash = $1 AND t.expires_at > now()
+		FOR UPDATE OF t;
+	`, hashTransferToken(token), userID)
+	err = row.Scan(&transfer.ID, &transfer.GalleryID, &transfer.FromUserID, &transfer.ToEmail, &email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("accept transfer: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	if transfer.ToEmail != email {
+		return nil, fmt.Errorf("accept transfer: %w", ErrNotFound)
+	}
+	err = lockGallery(tx, transfer.GalleryID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	err = service.checkTransferQuota(tx, transfer.GalleryID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE galleries
+		SET user_id = $3, collection_id = NULL
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL;
+	`, transfer.GalleryID, transfer.FromUserID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	err = checkRowsAffected(result, "accept transfer")
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM gallery_transfers
+		WHERE id = $1;
+	`, transfer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept transfer: %w", err)
+	}
+	return service.ByID(transfer.GalleryID)
+}
+
+func hashTransferToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,290 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Values of Transform.Fit.
+const (
+	// FitContain scales the image to fit inside the width and height,
+	// keeping all of it.
+	FitContain = "contain"
+	// FitCover scales the image to fill the width and height, cropping what
+	// is left over according to the gravity.
+	FitCover = "cover"
+)
+
+// Output formats of transforms.
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+)
+
+const (
+	// MaxTransformDimension is the largest width or height a transform can
+	// ask for.
+	MaxTransformDimension   = 4096
+	DefaultTransformQuality = FallbackJPEGQuality
+)
+
+// TransformGravities map the gravities a FitCover crop can keep to the
+// position of the crop in the image, from 0 (left or top) to 1 (right or
+// bottom).
+var TransformGravities = map[string][2]float64{
+	"center":    {0.5, 0.5},
+	"north":     {0.5, 0},
+	"south":     {0.5, 1},
+	"east":      {1, 0.5},
+	"west":      {0, 0.5},
+	"northeast": {1, 0},
+	"northwest": {0, 0},
+	"southeast": {1, 1},
+	"southwest": {0, 1},
+}
+
+// TransformPresets are the transforms anyone who can see an image can ask
+// for by name. Any other transform needs a signature.
+var TransformPresets = map[string]Transform{
+	"thumb":  {Width: 300, Height: 300, Fit: FitCover},
+	"card":   {Width: 600, Height: 400, Fit: FitCover},
+	"hero":   {Width: 1920, Height: 800, Fit: FitCover},
+	"inline": {Width: 1200, Height: 1200, Fit: FitContain},
+}
+
+var ErrInvalidTransform = errors.New("models: invalid transform")
+
+// Transform describes how to crop, scale and encode an image. Images are
+// never scaled up.
+type Transform struct {
+	// Width and Height bound the result in pixels. Either can be zero to
+	// follow the aspect ratio of the image.
+	Width  int
+	Height int
+	// Fit is FitContain or FitCover. It only matters when both Width and
+	// Height are set.
+	Fit     string
+	Gravity string
+	// Quality goes from 1 to 100, and only matters for JPEG.
+	Quality int
+	Format  string
+}
+
+// ParseTransform reads a transform from the "w", "h", "fit", "gravity", "q"
+// and "fm" values, or from the "preset" value. Missing values get their
+// defaults.
+func ParseTransform(values url.Values) (Transform, error) {
+	var t Transform
+	if name := values.Get("preset"); name != "" {
+		preset, ok := TransformPresets[name]
+		if !ok {
+			return Transform{}, fmt.Errorf("parse transform: %w", ErrInvalidTransform)
+		}
+		t = preset
+	} else {
+		for name, dst := range map[string]*int{"w": &t.Width, "h": &t.Height, "q": &t.Quality} {
+			if value := values.Get(name); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return Transform{}, fmt.Errorf("parse transform: %w", ErrInvalidTransform)
+				}
+				*dst = n
+			}
+		}
+		t.Fit = values.Get("fit")
+		t.Gravity = values.Get("gravity")
+		t.Format = values.Get("fm")
+	}
+	t = t.withDefaults()
+	if !t.valid() {
+		return Transform{}, fmt.Errorf("parse transform: %w", ErrInvalidTransform)
+	}
+	return t, nil
+}
+
+func (t Transform) withDefaults() Transform {
+	if t.Fit == "" {
+		t.Fit = FitContain
+	}
+	if t.Gravity == "" {
+		t.Gravity = "center"
+	}
+	if t.Quality == 0 {
+		t.Quality = DefaultTransformQuality
+	}
+	if t.Format == "" {
+		t.Format = FormatJPEG
+	}
+	return t
+}
+
+func (t Transform) valid() bool {
+	if t.Width < 0 || t.Width > MaxTransformDimension || t.Height < 0 || t.Height > MaxTransformDimension {
+		return false
+	}
+	if t.Width == 0 && t.Height == 0 {
+		return false
+	}
+	if t.Fit != FitContain && t.Fit != FitCover {
+		return false
+	}
+	if _, ok := TransformGravities[t.Gravity]; !ok {
+		return false
+	}
+	if t.Quality < 1 || t.Quality > 100 {
+		return false
+	}
+	return t.Format == FormatJPEG || t.Format == FormatPNG
+}
+
+// Encode returns the transform as query values, always in the same order so
+// it can be signed.
+func (t Transform) Encode() string {
+	values := url.Values{}
+	if t.Width > 0 {
+		values.Set("w", strconv.Itoa(t.Width))
+	}
+	if t.Height > 0 {
+		values.Set("h", strconv.Itoa(t.Height))
+	}
+	values.Set("fit", t.Fit)
+	values.Set("gravity", t.Gravity)
+	values.Set("q", strconv.Itoa(t.Quality))
+	values.Set("fm", t.Format)
+	return values.Encode()
+}
+
+// IsPreset reports whether t is one of the TransformPresets.
+func (t Transform) IsPreset() bool {
+	for _, preset := range TransformPresets {
+		if preset.withDefaults() == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (t Transform) ContentType() string {
+	if t.Format == FormatPNG {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// SignTransform returns the signature that allows a transform of an image
+// that isn't a preset. It is empty without a TransformKey.
+func (service *GalleryService) SignTransform(imageID string, t Transform) string {
+	if len(service.TransformKey) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, service.TransformKey)
+	mac.Write([]byte(imageID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(t.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyTransform reports whether signature allows a transform of an image.
+func (service *GalleryService) VerifyTransform(imageID string, t Transform, signature string) bool {
+	expected := service.SignTransform(imageID, t)
+	return expected != "" && hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Transformed opens a transformed version of an image, rendering it if it
+// isn't in the RenderCache. Callers must close the file.
+func (service *GalleryService) Transformed(image Image, t Transform) (*os.File, error) {
+	if service.RenderCache == nil {
+		return nil, fmt.Errorf("transformed image: no render cache")
+	}
+	// Keys of images include their content hash, and those of watermarked
+	// images their watermark, so renders of changed images aren't reused.
+	h := sha256.New()
+	h.Write([]byte(image.Key))
+	h.Write([]byte{0})
+	h.Write([]byte(t.Encode()))
+	key := hex.EncodeToString(h.Sum(nil)) + "." + t.Format
+
+	f, err := service.RenderCache.Open(key, func(w io.Writer) error {
+		src, err := service.storage().Get(image.Key)
+		if err != nil {
+			return fmt.Errorf("opening image: %w", err)
+		}
+		defer src.Close()
+		return encodeTransformed(w, src, t)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("transformed image: %w", err)
+	}
+	return f, nil
+}
+
+func encodeTransformed(dst io.Writer, src io.Reader, t Transform) error {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+	img = t.apply(img)
+	switch t.Format {
+	case FormatPNG:
+		err = png.Encode(dst, img)
+	default:
+		err = jpeg.Encode(dst, flatten(img), &jpeg.Options{Quality: t.Quality})
+	}
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", t.Format, err)
+	}
+	return nil
+}
+
+// apply crops and scales img.
+func (t Transform) apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := float64(bounds.Dx()), float64(bounds.Dy())
+	width, height := float64(t.Width), float64(t.Height)
+	crop := bounds
+
+	switch {
+	case t.Width == 0:
+		width = srcWidth * height / srcHeight
+	case t.Height == 0:
+		height = srcHeight * width / srcWidth
+	case t.Fit == FitCover:
+		scale := math.Max(width/srcWidth, height/srcHeight)
+		if scale > 1 {
+			// Keep the aspect ratio asked for, at the size of the image.
+			width, height = width/scale, height/scale
+			scale = 1
+		}
+		cropWidth, cropHeight := width/scale, height/scale
+		gravity := TransformGravities[t.Gravity]
+		x := bounds.Min.X + int(math.Round((srcWidth-cropWidth)*gravity[0]))
+		y := bounds.Min.Y + int(math.Round((srcHeight-cropHeight)*gravity[1]))
+		crop = image.Rect(x, y, x+int(math.Round(cropWidth)), y+int(math.Round(cropHeight)))
+	default:
+		scale := math.Min(width/srcWidth, height/srcHeight)
+		width, height = srcWidth*scale, srcHeight*scale
+	}
+	if scale := width / float64(crop.Dx()); scale > 1 {
+		width, height = width/scale, height/scale
+	}
+
+	// Very long and thin images would otherwise lose a side entirely.
+	w := int(math.Max(1, math.Round(width)))
+	h := int(math.Max(1, math.Round(height)))
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, crop, draw.Src, nil)
+	return scaled
+}
@@ -0,0 +1,306 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultTrashRetention is how long galleries and images stay in the
+	// trash before they are deleted for good.
+	DefaultTrashRetention = 30 * 24 * time.Hour
+)
+
+// Trash is what a user deleted and can still restore. Galleries are restored
+// with all their images. Images deleted on their own are only listed while
+// their gallery isn't in the trash too.
+type Trash struct {
+	Galleries []TrashedGallery
+	Images    []TrashedImage
+}
+
+type TrashedGallery struct {
+	ID    int
+	Title string
+	// Images counts the images that come back with the gallery.
+	Images    int
+	DeletedAt time.Time
+}
+
+type TrashedImage struct {
+	Image
+	GalleryTitle string
+	DeletedAt    time.Time
+}
+
+// Trash moves a gallery to the trash. It disappears along with its images
+// until it is restored, or purged.
+func (service *GalleryService) Trash(id int) error {
+	result, err := service.DB.Exec(`
+		UPDATE galleries
+		SET deleted_at = now()
+		WHERE id = $1 AND deleted_at IS NULL;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("trash gallery: %w", err)
+	}
+	return checkRowsAffected(result, "trash gallery")
+}
+
+// TrashImage moves an image to the trash.
+func (service *GalleryService) TrashImage(galleryID int, id string) error {
+	result, err := service.DB.Exec(`
+		UPDATE images
+		SET deleted_at = now()
+		WHERE gallery_id = $1 AND public_id = $2 AND deleted_at IS NULL;
+	`, galleryID, id)
+	if err != nil {
+		return fmt.Errorf("trash image: %w", err)
+	}
+	return checkRowsAffected(result, "trash image")
+}
+
+// TrashImages moves several images of a gallery to the trash at once.
+func (service *GalleryService) TrashImages(galleryID int, ids []string) error {
+	_, err := service.DB.Exec(`
+		UPDATE images
+		SET deleted_at = now()
+		WHERE gallery_id = $1 AND public_id = ANY($2) AND deleted_at IS NULL;
+	`, galleryID, ids)
+	if err != nil {
+		return fmt.Errorf("trash images: %w", err)
+	}
+	return nil
+}
+
+// TrashByUserID returns the trash of a user, most recently deleted first.
+func (service *GalleryService) TrashByUserID(userID int) (Trash, error) {
+	var trash Trash
+	rows, err := service.DB.Query(`
+		SELECT g.id, coalesce(g.title, ''), g.deleted_at, count(i.id)
+		FROM galleries g
+		LEFT JOIN images i ON i.gallery_id = g.id AND i.deleted_at IS NULL
+		WHERE g.user_id = $1 AND g.deleted_at IS NOT NULL
+		GROUP BY g.id
+		ORDER BY g.deleted_at DESC, g.id;
+	`, userID)
+	if err != nil {
+		return Trash{}, fmt.Errorf("query trash: %w", err)
+	}
+	for rows.Next() {
+		var gallery TrashedGallery
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.DeletedAt, &gallery.Images)
+		if err != nil {
+			rows.Close()
+			return Trash{}, fmt.Errorf("query trash: %w", err)
+		}
+		trash.Galleries = append(trash.Galleries, gallery)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Trash{}, fmt.Errorf("query trash: %w", err)
+	}
+
+	rows, err = service.DB.Query(`
+		SELECT i.public_id, i.gallery_id, i.filename, i.content_hash, coalesce(g.title, ''), i.deleted_at
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		WHERE g.user_id = $1 AND i.deleted_at IS NOT NULL AND g.deleted_at IS NULL
+		ORDER BY i.deleted_at DESC, i.filename;
+	`, userID)
+	if err != nil {
+		return Trash{}, fmt.Errorf("query trash: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var image TrashedImage
+		err := rows.Scan(&image.ID, &image.GalleryID, &image.Filename, &image.ContentHash, &image.GalleryTitle,
+			&image.DeletedAt)
+		if err != nil {
+			return Trash{}, fmt.Errorf("query trash: %w", err)
+		}
+		image.Key = blobKey(image.ContentHash)
+		trash.Images = append(trash.Images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return Trash{}, fmt.Errorf("query trash: %w", err)
+	}
+	return trash, nil
+}
+
+// TrashedImage returns an image of a user that is in the trash, so it can be
+// shown before it is restored.
+func (service *GalleryService) TrashedImage(userID int, id string) (Image, error) {
+	image := Image{ID: id}
+	row := service.DB.QueryRow(`
+		SELECT i.gallery_id, i.filename, i.content_hash
+		FROM images i
+		JOIN galleries g ON g.id = i.gallery_id
+		WHERE g.user_id = $1 AND i.public_id = $2 AND (i.deleted_at IS NOT NULL OR g.deleted_at IS NOT NULL);
+	`, userID, id)
+	err := row.Scan(&image.GalleryID, &image.Filename, &image.ContentHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, fmt.Errorf("query trashed image: %w", err)
+	}
+	image.Key = blobKey(image.ContentHash)
+	return image, nil
+}
+
+// RestoreGallery takes a gallery of a user out of the trash.
+func (service *GalleryService) RestoreGallery(userID, id int) error {
+	result, err := service.DB.Exec(`
+		UPDATE galleries
+		SET deleted_at = NULL
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL;
+	`, id, userID)
+	if err != nil {
+		return fmt.Errorf("restore gallery: %w", err)
+	}
+	return checkRowsAffected(result, "restore gallery")
+}
+
+// RestoreImage takes an image of a user out of the trash, back into its
+// gallery. Its filename was kept free while it was in the trash.
+func (service *GalleryService) RestoreImage(userID int, id string) error {
+	result, err := service.DB.Exec(`
+		UPDATE images i
+		SET deleted_at = NULL
+		FROM galleries g
+		WHERE g.id = i.gallery_id AND g.user_id = $1 AND i.public_id = $2
+			AND i.deleted_at IS NOT NULL AND g.deleted_at IS NULL;
+	`, userID, id)
+	if err != nil {
+		return fmt.Errorf("restore image: %w", err)
+	}
+	return checkRowsAffected(result, "restore image")
+}
+
+// EmptyTrash deletes for good everything in the trash of a user.
+func (service *GalleryService) EmptyTrash(userID int) error {
+	_, err := service.purgeTrash(userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("empty trash: %w", err)
+	}
+	return nil
+}
+
+// PurgeTrash deletes for good the galleries and images of every user that
+// have been in the trash for longer than retention. It returns how many were
+// deleted.
+func (service *GalleryService) PurgeTrash(retention time.Duration) (int, error) {
+	purged, err := service.purgeTrash(0, time.Now().Add(-retention))
+	if err != nil {
+		return purged, fmt.Errorf("purge trash: %w", err)
+	}
+	return purged, nil
+}
+
+// purgeTrash deletes the galleries and images trashed before the given time,
+// those of a single user unless userID is 0. The image files are shared with
+// other galleries, so they are only released here and removed later by
+// CollectGarbage.
+func (service *GalleryService) purgeTrash(userID int, before time.Time) (int, error) {
+	tx, err := service.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the galleries first, so they can't be restored once their images
+	// have been released.
+	rows, err := tx.Query(`
+		SELECT id
+		FROM galleries
+		WHERE deleted_at < $1 AND ($2 = 0 OR user_id = $2)
+		FOR UPDATE;
+	`, before, userID)
+	if err != nil {
+		return 0, err
+	}
+	var galleryIDs []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		galleryIDs = append(galleryIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	released := make(map[string]int)
+	rows, err = tx.Query(`
+		SELECT content_hash
+		FROM images
+		WHERE gallery_id = ANY($1);
+	`, galleryIDs)
+	if err != nil {
+		return 0, err
+	}
+	err = countHashes(rows, released)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		DELETE FROM galleries
+		WHERE id = ANY($1);
+	`, galleryIDs)
+	if err != nil {
+		return 0, err
+	}
+	purged := len(galleryIDs)
+
+	rows, err = tx.Query(`
+		DELETE FROM images i
+		USING galleries g
+		WHERE g.id = i.gallery_id AND i.deleted_at < $1 AND ($2 = 0 OR g.user_id = $2)
+		RETURNING i.content_hash;
+	`, before, userID)
+	if err != nil {
+		return 0, err
+	}
+	images := make(map[string]int)
+	err = countHashes(rows, images)
+	if err != nil {
+		return 0, err
+	}
+	for hash, count := range images {
+		released[hash] += count
+		purged += count
+	}
+
+	for hash, count := range released {
+		err = service.releaseBlob(tx, hash, count)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// countHashes reads and closes rows of content hashes, counting each one.
+func countHashes(rows *sql.Rows, counts map[string]int) error {
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		err := rows.Scan(&hash)
+		if err != nil {
+			return err
+		}
+		counts[hash]++
+	}
+	return rows.Err()
+}
@@ -0,0 +1,351 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"archazid.io/lenslocked/rand"
+)
+
+const (
+	// Default time an unfinished upload is kept before it expires.
+	DefaultUploadDuration = 24 * time.Hour
+	// Default maximum size of a single resumable upload.
+	DefaultMaxUploadSize = 200 << 20 // 200mb
+)
+
+var (
+	ErrUploadOffset = errors.New("models: upload offset does not match")
+	ErrUploadLocked = errors.New("models: upload is being written to")
+	ErrUploadTooBig = errors.New("models: upload exceeds its length")
+)
+
+// Upload is a file being uploaded in chunks, which can be resumed after the
+// connection drops.
+type Upload struct {
+	ID        string
+	UserID    int
+	GalleryID int
+	Filename  string
+	// Length is the total size of the file in bytes, Offset how many of those
+	// have been received so far.
+	Length    int64
+	Offset    int64
+	ExpiresAt time.Time
+}
+
+func (upload Upload) Complete() bool {
+	return upload.Offset == upload.Length
+}
+
+// UploadService keeps track of resumable uploads. The received data is
+// written to files on local disk, so every request of an upload must reach
+// the same server.
+type UploadService struct {
+	DB *sql.DB
+	// The directory where partial uploads are stored. Defaults to "uploads".
+	Dir string
+	// Time an unfinished upload is kept since it was last written to.
+	Duration time.Duration
+	// Largest file size accepted. Defaults to DefaultMaxUploadSize.
+	MaxSize int64
+
+	mu sync.Mutex
+	// writing holds the IDs of the uploads a request is writing to.
+	writing map[string]bool
+}
+
+func (service *UploadService) Create(userID, galleryID int, filename string, length int64) (*Upload, error) {
+	if length < 0 || length > service.maxSize() {
+		return nil, fmt.Errorf("create upload: %w", ErrUploadTooBig)
+	}
+	id, err := rand.String(MinBytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	upload := Upload{
+		ID:        id,
+		UserID:    userID,
+		GalleryID: galleryID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: time.Now().Add(service.duration()),
+	}
+
+	err = os.MkdirAll(service.dir(), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	f, err := os.Create(service.path(upload.ID))
+	if err != nil {
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	f.Close()
+
+	_, err = service.DB.Exec(`
+		INSERT INTO uploads (id, user_id, gallery_id, filename, length, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`, upload.ID, upload.UserID, upload.GalleryID, upload.Filename, upload.Length, upload.ExpiresAt)
+	if err != nil {
+		os.Remove(service.path(upload.ID))
+		return nil, fmt.Errorf("create upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// ByID returns an upload that hasn't expired yet.
+func (service *UploadService) ByID(id string) (*Upload, error) {
+	upload, err := service.byID(id)
+	if err != nil {
+		return nil, fmt.Errorf("query upload by id: %w", err)
+	}
+	return upload, nil
+}
+
+// Append writes data to an upload, starting at offset. The offset must match
+// the number of bytes received so far, which makes retrying a chunk after a
+// dropped connection safe. The updated upload is returned, even on error, as
+// part of the data may have been written.
+//
+// The data is written without holding a transaction, as slow clients can
+// take long to send it. Instead, the upload is locked in memory, which works
+// as every request of an upload reaches the same server, and the offset is
+// only moved forward if nothing else moved it meanwhile.
+func (service *UploadService) Append(id string, offset int64, data io.Reader) (*Upload, error) {
+	if !service.startWriting(id) {
+		return nil, fmt.Errorf("append upload: %w", ErrUploadLocked)
+	}
+	defer service.stopWriting(id)
+
+	upload, err := service.byID(id)
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	if offset != upload.Offset {
+		return upload, fmt.Errorf("append upload: %w", ErrUploadOffset)
+	}
+
+	f, err := os.OpenFile(service.path(id), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	defer f.Close()
+	// A previous request may have written data after the recorded offset
+	// before failing. That data is discarded.
+	err = f.Truncate(upload.Offset)
+	if err == nil {
+		_, err = f.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+
+	// Read one byte past the remaining length to detect clients sending more
+	// than they announced.
+	remaining := upload.Length - upload.Offset
+	n, copyErr := io.Copy(f, io.LimitReader(data, remaining+1))
+	if n > remaining {
+		return upload, fmt.Errorf("append upload: %w", ErrUploadTooBig)
+	}
+	err = f.Sync()
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+
+	// Whatever made it to disk counts, even if the connection dropped, so the
+	// client can resume from there.
+	expiresAt := time.Now().Add(service.duration())
+	result, err := service.DB.Exec(`
+		UPDATE uploads
+		SET upload_offset = $3, expires_at = $4
+		WHERE id = $1 AND upload_offset = $2 AND expires_at > now();
+	`, upload.ID, upload.Offset, upload.Offset+n, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("append upload: %w", err)
+	}
+	err = checkRowsAffected(result, "append upload")
+	if err != nil {
+		// The upload expired, was deleted or was written to by another
+		// server while the data was coming in.
+		current, lookupErr := service.byID(id)
+		if lookupErr != nil {
+			return nil, fmt.Errorf("append upload: %w", lookupErr)
+		}
+		return current, fmt.Errorf("append upload: %w", ErrUploadOffset)
+	}
+	upload.Offset += n
+	upload.ExpiresAt = expiresAt
+	if copyErr != nil {
+		return upload, fmt.Errorf("append upload: %w", copyErr)
+	}
+	return upload, nil
+}
+
+// startWriting locks an upload for a request writing to it. It reports false
+// if another request holds the lock.
+func (service *UploadService) startWriting(id string) bool {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	if service.writing[id] {
+		return false
+	}
+	if service.writing == nil {
+		service.writing = make(map[string]bool)
+	}
+	service.writing[id] = true
+	return true
+}
+
+func (service *UploadService) stopWriting(id string) {
+	service.mu.Lock()
+	defer service.mu.Unlock()
+	delete(service.writing, id)
+}
+
+// Claim takes a finished upload for the request that hands it to the
+// gallery. Its record is removed at once, so a retried or duplicate request
+// can't hand it over a second time; the data stays until Delete. ErrNotFound
+// is returned if the upload isn't finished or was already claimed.
+func (service *UploadService) Claim(id string) (*Upload, error) {
+	upload := Upload{
+		ID: id,
+	}
+	row := service.DB.QueryRow(`
+		DELETE FROM uploads
+		WHERE id = $1 AND upload_offset = length AND expires_at > now()
+		RETURNING user_id, gallery_id, filename, length, upload_offset, expires_at;
+	`, id)
+	err := row.Scan(&upload.UserID, &upload.GalleryID, &upload.Filename,
+		&upload.Length, &upload.Offset, &upload.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("claim upload: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("claim upload: %w", err)
+	}
+	return &upload, nil
+}
+
+// Open opens the data received for an upload. Callers must close it.
+func (service *UploadService) Open(upload *Upload) (*os.File, error) {
+	f, err := os.Open(service.path(upload.ID))
+	if err != nil {
+		return nil, fmt.Errorf("open upload: %w", err)
+	}
+	return f, nil
+}
+
+func (service *UploadService) Delete(id string) error {
+	_, err := service.DB.Exec(`
+		DELETE FROM uploads
+		WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	err = os.Remove(service.path(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("delete upload: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes uploads that haven't been written to for longer than
+// the upload duration, along with files left behind by uploads that no longer
+// exist, like those of deleted galleries.
+func (service *UploadService) DeleteExpired() error {
+	rows, err := service.DB.Query(`
+		DELETE FROM uploads
+		WHERE expires_at < $1
+		RETURNING id;
+	`, time.Now())
+	if err != nil {
+		return fmt.Errorf("delete expired uploads: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return fmt.Errorf("delete expired uploads: %w", err)
+		}
+		err = os.Remove(service.path(id))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("delete expired uploads: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("delete expired uploads: %w", err)
+	}
+
+	entries, err := os.ReadDir(service.dir())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("delete expired uploads: %w", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < service.duration() {
+			continue
+		}
+		_, err = service.byID(entry.Name())
+		if errors.Is(err, ErrNotFound) {
+			os.Remove(filepath.Join(service.dir(), entry.Name()))
+		}
+	}
+	return nil
+}
+
+func (service *UploadService) byID(id string) (*Upload, error) {
+	upload := Upload{
+		ID: id,
+	}
+	row := service.DB.QueryRow(`
+		SELECT user_id, gallery_id, filename, length, upload_offset, expires_at
+		FROM uploads
+		WHERE id = $1 AND expires_at > now();
+	`, id)
+	err := row.Scan(&upload.UserID, &upload.GalleryID, &upload.Filename,
+		&upload.Length, &upload.Offset, &upload.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func (service *UploadService) path(id string) string {
+	return filepath.Join(service.dir(), filepath.Base(id))
+}
+
+func (service *UploadService) dir() string {
+	if service.Dir == "" {
+		return "uploads"
+	}
+	return service.Dir
+}
+
+func (service *UploadService) duration() time.Duration {
+	if service.Duration == 0 {
+		return DefaultUploadDuration
+	}
+	return service.Duration
+}
+
+func (service *UploadService) maxSize() int64 {
+	if service.MaxSize == 0 {
+		return DefaultMaxUploadSize
+	}
+	return service.MaxSize
+}
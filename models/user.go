@@ -2,6 +2,7 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -12,6 +13,9 @@ type User struct {
 	ID           int
 	Email        string
 	PasswordHash string
+	// Admin lets the user see problems across every user, like corrupted
+	// images.
+	Admin bool
 }
 
 type UserService struct {
@@ -89,3 +93,22 @@ func (us *UserService) UpdatePassword(userID int, password string) error {
 
 	return nil
 }
+
+func (us *UserService) ByID(id int) (*User, error) {
+	user := User{
+		ID: id,
+	}
+	row := us.DB.QueryRow(`
+		SELECT email, password_hash
+		FROM users
+		WHERE id = $1;
+	`, id)
+	err := row.Scan(&user.Email, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("query user by id: %w", err)
+	}
+	return &user, nil
+}
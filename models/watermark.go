@@ -0,0 +1,365 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Where a watermark is drawn on images.
+const (
+	WatermarkCenter      = "center"
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	// WatermarkTiled repeats the watermark over the whole image.
+	WatermarkTiled = "tiled"
+
+	MaxWatermarkLogoSize = 1 << 20
+	// MaxWatermarkLogoDimension limits the width and height of logos, which
+	// are decoded in full for every watermarked image.
+	MaxWatermarkLogoDimension = 4096
+)
+
+var WatermarkPositions = []string{
+	WatermarkBottomRight, WatermarkBottomLeft, WatermarkTopRight, WatermarkTopLeft,
+	WatermarkCenter, WatermarkTiled,
+}
+
+var ErrInvalidWatermark = errors.New("models: invalid watermark settings")
+
+// Watermark is how a user marks the images visitors see in their watermarked
+// galleries: with a PNG logo if there is one, or else with text.
+type Watermark struct {
+	UserID int
+	Text   string
+	// Logo is a PNG image, with transparency if wanted.
+	Logo     []byte
+	Position string
+	// Opacity goes from just above 0, invisible, to 1, opaque.
+	Opacity float64
+	// Scale is the width of the watermark as a fraction of the image width.
+	Scale float64
+}
+
+// DefaultWatermark returns the settings of users who haven't set up their
+// watermark yet. It has neither logo nor text, so it isn't drawn.
+func DefaultWatermark(userID int) Watermark {
+	return Watermark{
+		UserID:   userID,
+		Position: WatermarkBottomRight,
+		Opacity:  0.5,
+		Scale:    0.25,
+	}
+}
+
+// Enabled reports whether there is anything to draw.
+func (wm Watermark) Enabled() bool {
+	return len(wm.Logo) > 0 || strings.TrimSpace(wm.Text) != ""
+}
+
+// version identifies the settings, so changing them creates new watermarked
+// images instead of serving the old ones.
+func (wm Watermark) version() string {
+	h := sha256.New()
+	h.Write([]byte(wm.Text))
+	h.Write([]byte{0})
+	h.Write(wm.Logo)
+	h.Write([]byte{0})
+	h.Write([]byte(wm.Position))
+	binary.Write(h, binary.BigEndian, wm.Opacity)
+	binary.Write(h, binary.BigEndian, wm.Scale)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func (wm Watermark) validate() error {
+	valid := false
+	for _, position := range WatermarkPositions {
+		if wm.Position == position {
+			valid = true
+		}
+	}
+	if !valid || wm.Opacity <= 0 || wm.Opacity > 1 || wm.Scale <= 0 || wm.Scale > 1 {
+		return ErrInvalidWatermark
+	}
+	if len(wm.Logo) > 0 {
+		if len(wm.Logo) > MaxWatermarkLogoSize {
+			return ErrInvalidWatermark
+		}
+		config, err := png.DecodeConfig(bytes.NewReader(wm.Logo))
+		if err != nil || config.Width > MaxWatermarkLogoDimension || config.Height > MaxWatermarkLogoDimension {
+			return ErrInvalidWatermark
+		}
+	}
+	return nil
+}
+
+type WatermarkService struct {
+	DB *sql.DB
+}
+
+// ByUserID returns the watermark of a user, or DefaultWatermark if they
+// haven't set one up.
+func (service *WatermarkService) ByUserID(userID int) (Watermark, error) {
+	wm := Watermark{UserID: userID}
+	row := service.DB.QueryRow(`
+		SELECT text, logo, position, opacity, scale
+		FROM watermarks
+		WHERE user_id = $1;
+	`, userID)
+	err := row.Scan(&wm.Text, &wm.Logo, &wm.Position, &wm.Opacity, &wm.Scale)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return DefaultWatermark(userID), nil
+		}
+		return Watermark{}, fmt.Errorf("query watermark: %w", err)
+	}
+	return wm, nil
+}
+
+// Update saves the watermark of a user. ErrInvalidWatermark is returned for
+// settings out of range and logos that aren't PNG images.
+func (service *WatermarkService) Update(wm Watermark) error {
+	err := wm.validate()
+	if err != nil {
+		return fmt.Errorf("update watermark: %w", err)
+	}
+	_, err = service.DB.Exec(`
+		INSERT INTO watermarks (user_id, text, logo, position, opacity, scale)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id) DO UPDATE
+		SET text = excluded.text, logo = excluded.logo, position = excluded.position,
+			opacity = excluded.opacity, scale = excluded.scale;
+	`, wm.UserID, wm.Text, wm.Logo, wm.Position, wm.Opacity, wm.Scale)
+	if err != nil {
+		return fmt.Errorf("update watermark: %w", err)
+	}
+	return nil
+}
+
+// Watermarked returns a JPEG version of an image with a watermark drawn over
+// it. It is generated the first time it is requested for these watermark
+// settings, and kept like the other variants of the image.
+func (service *GalleryService) Watermarked(image Image, wm Watermark) (Image, error) {
+	watermarked := Image{
+		GalleryID:   image.GalleryID,
+		Key:         variantKey(image.ContentHash, "-wm-"+wm.version()+".jpg"),
+		Filename:    strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename)) + ".jpg",
+		ContentHash: image.ContentHash,
+	}
+	err := service.variant(image, watermarked.Key, func(dst io.Writer, src io.Reader) error {
+		return encodeWatermarkedJPEG(dst, src, wm)
+	})
+	if err != nil {
+		return Image{}, fmt.Errorf("watermarked image: %w", err)
+	}
+	return watermarked, nil
+}
+
+// WatermarkedResized returns a JPEG version of an image scaled down to fit
+// the given size, with a watermark drawn over it. The watermark is drawn
+// after scaling, so it covers the same part of the image at every size.
+func (service *GalleryService) WatermarkedResized(image Image, size ImageSize, wm Watermark) (Image, error) {
+	resized, err := service.Resized(image, size)
+	if err != nil {
+		return Image{}, fmt.Errorf("watermarked resized image: %w", err)
+	}
+	watermarked := Image{
+		GalleryID:   image.GalleryID,
+		Key:         variantKey(image.ContentHash, fmt.Sprintf("-%d-wm-%s.jpg", size.MaxDimension, wm.version())),
+		Filename:    resized.Filename,
+		ContentHash: image.ContentHash,
+	}
+	err = service.variant(resized, watermarked.Key, func(dst io.Writer, src io.Reader) error {
+		return encodeWatermarkedJPEG(dst, src, wm)
+	})
+	if err != nil {
+		return Image{}, fmt.Errorf("watermarked resized image: %w", err)
+	}
+	return watermarked, nil
+}
+
+func encodeWatermarkedJPEG(dst io.Writer, src io.Reader, wm Watermark) error {
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return fmt.Errorf("decoding image: %w", err)
+	}
+	canvas := image.NewRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), flatten(img), img.Bounds().Min, draw.Src)
+	err = drawWatermark(canvas, wm)
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(dst, canvas, &jpeg.Options{Quality: FallbackJPEGQuality})
+	if err != nil {
+		return fmt.Errorf("encoding jpeg: %w", err)
+	}
+	return nil
+}
+
+// drawWatermark draws wm over canvas.
+func drawWatermark(canvas *image.RGBA, wm Watermark) error {
+	bounds := canvas.Bounds()
+	width := int(math.Round(float64(bounds.Dx()) * wm.Scale))
+	if width < 1 {
+		width = 1
+	}
+	var mark image.Image
+	var err error
+	if len(wm.Logo) > 0 {
+		mark, err = watermarkLogo(wm.Logo, width)
+	} else {
+		mark, err = watermarkText(wm.Text, width)
+	}
+	if err != nil {
+		return err
+	}
+
+	opacity := image.NewUniform(color.Alpha{A: uint8(math.Round(wm.Opacity * 255))})
+	size := mark.Bounds().Size()
+	margin := bounds.Dx()
+	if bounds.Dy() < margin {
+		margin = bounds.Dy()
+	}
+	margin = margin * 3 / 100
+
+	var positions []image.Point
+	switch wm.Position {
+	case WatermarkTiled:
+		// Leave as much space between marks as they take, and shift every
+		// other row so the marks are harder to crop out.
+		stepX, stepY := size.X*2, size.Y*3
+		for row, y := 0, bounds.Min.Y; y < bounds.Max.Y; row, y = row+1, y+stepY {
+			x := bounds.Min.X - (row%2)*size.X
+			for ; x < bounds.Max.X; x += stepX {
+				positions = append(positions, image.Pt(x, y))
+			}
+		}
+	case WatermarkTopLeft:
+		positions = append(positions, image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin))
+	case WatermarkTopRight:
+		positions = append(positions, image.Pt(bounds.Max.X-margin-size.X, bounds.Min.Y+margin))
+	case WatermarkBottomLeft:
+		positions = append(positions, image.Pt(bounds.Min.X+margin, bounds.Max.Y-margin-size.Y))
+	case WatermarkCenter:
+		positions = append(positions, image.Pt(bounds.Min.X+(bounds.Dx()-size.X)/2, bounds.Min.Y+(bounds.Dy()-size.Y)/2))
+	default:
+		positions = append(positions, image.Pt(bounds.Max.X-margin-size.X, bounds.Max.Y-margin-size.Y))
+	}
+	for _, pt := range positions {
+		r := image.Rectangle{Min: pt, Max: pt.Add(size)}
+		draw.DrawMask(canvas, r, mark, mark.Bounds().Min, opacity, image.Point{}, draw.Over)
+	}
+	return nil
+}
+
+// watermarkLogo scales a PNG logo to the given width. Logos saved before
+// their dimensions were limited are checked again before decoding them.
+func watermarkLogo(logo []byte, width int) (image.Image, error) {
+	config, err := png.DecodeConfig(bytes.NewReader(logo))
+	if err != nil {
+		return nil, fmt.Errorf("decoding watermark logo: %w", err)
+	}
+	if config.Width > MaxWatermarkLogoDimension || config.Height > MaxWatermarkLogoDimension {
+		return nil, fmt.Errorf("decoding watermark logo: %w", ErrInvalidWatermark)
+	}
+	img, err := png.Decode(bytes.NewReader(logo))
+	if err != nil {
+		return nil, fmt.Errorf("decoding watermark logo: %w", err)
+	}
+	bounds := img.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Over, nil)
+	return scaled, nil
+}
+
+// watermarkText renders text in white with a dark shadow, so it shows on
+// light and dark images alike, sized to fill the given width.
+func watermarkText(text string, width int) (image.Image, error) {
+	text = strings.TrimSpace(text)
+	f, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("parsing watermark font: %w", err)
+	}
+	// Measure the text at a reference size to find the size that fits.
+	const referenceSize = 100
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: referenceSize, DPI: 72})
+	if err != nil {
+		return nil, fmt.Errorf("creating watermark font: %w", err)
+	}
+	measured := font.MeasureString(face, text).Ceil()
+	face.Close()
+	if measured < 1 {
+		measured = 1
+	}
+	size := float64(referenceSize) * float64(width) / float64(measured)
+	if size < 1 {
+		size = 1
+	}
+	face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("creating watermark font: %w", err)
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	shadow := int(math.Ceil(size / 25))
+	textWidth := font.MeasureString(face, text).Ceil()
+	mark := image.NewRGBA(image.Rect(0, 0, textWidth+shadow, (metrics.Ascent+metrics.Descent).Ceil()+shadow))
+	drawer := font.Drawer{
+		Dst:  mark,
+		Src:  image.NewUniform(color.RGBA{A: 160}),
+		Face: face,
+		Dot:  fixed.Point26_6{X: fixed.I(shadow), Y: metrics.Ascent + fixed.I(shadow)},
+	}
+	drawer.DrawString(text)
+	drawer.Src = image.White
+	drawer.Dot = fixed.Point26_6{Y: metrics.Ascent}
+	drawer.DrawString(text)
+	return mark, nil
+}
+
+// WatermarkPreview writes a JPEG of wm drawn over a plain sample image, so
+// users can see their settings before visitors do.
+func WatermarkPreview(w io.Writer, wm Watermark) error {
+	canvas := image.NewRGBA(image.Rect(0, 0, 900, 600))
+	for y := 0; y < 600; y++ {
+		for x := 0; x < 900; x++ {
+			canvas.SetRGBA(x, y, color.RGBA{R: uint8(60 + x*120/900), G: uint8(90 + y*100/600), B: 140, A: 255})
+		}
+	}
+	if wm.Enabled() {
+		err := drawWatermark(canvas, wm)
+		if err != nil {
+			return fmt.Errorf("watermark preview: %w", err)
+		}
+	}
+	err := jpeg.Encode(w, canvas, &jpeg.Options{Quality: FallbackJPEGQuality})
+	if err != nil {
+		return fmt.Errorf("watermark preview: %w", err)
+	}
+	return nil
+}